@@ -4,64 +4,70 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/duanjr/trustchain/record"
 	"github.com/ethereum/go-ethereum/common"
 	"log"
-	"math"
-	"math/big"
-	"strings"
 	"time"
 )
 
-const targetBits = 16
-const maxNonce = math.MaxInt64
+const blockVersion = 2
 
-type Block struct {
-	Timestamp           int64
-	Records             []string
+// BlockHeader holds every field covered by the block hash. Signature, the
+// seal of engines that sign blocks, and Certificate, the engine's proof that
+// the block is final, are left out since they sign the hash itself.
+type BlockHeader struct {
+	Version             int
 	PrevBlockHash       []byte
-	Hash                []byte
-	Nonce               int
+	RecordsRoot         []byte
 	PkiRootHash         common.Hash
 	DirectTrustRootHash common.Hash
 	CompTrustRootHash   common.Hash
+	Timestamp           int64
+	TargetBits          int
+	Nonce               int
+	Proposer            string
+	Signature           []byte
+	Certificate         []byte
 }
 
-func newBlock(records []string, prevBlockHash []byte, pkiRootHash common.Hash,
-	directTrustRootHash common.Hash, compTrustRootHash common.Hash) *Block {
-	block := &Block{time.Now().Unix(), records, prevBlockHash,
-		[]byte{}, 0, pkiRootHash, directTrustRootHash, compTrustRootHash}
-	block.mine()
-
-	return block
+type Block struct {
+	BlockHeader
+	Records []*record.Record
+	Hash    []byte
 }
 
-func (b *Block) mine() {
-	var hashInt big.Int
-	var hash [32]byte
-
-	target := big.NewInt(1)
-	target.Lsh(target, uint(256-targetBits))
-
-	for b.Nonce = 0; b.Nonce < maxNonce; b.Nonce++ {
-		data := b.prepareData()
-		hash = sha256.Sum256(data)
-		hashInt.SetBytes(hash[:])
-
-		if hashInt.Cmp(target) == -1 {
-			b.Hash = hash[:]
-			break
-		}
+func newHeader(records []*record.Record, prevBlockHash []byte, pkiRootHash common.Hash,
+	directTrustRootHash common.Hash, compTrustRootHash common.Hash) *BlockHeader {
+	return &BlockHeader{
+		Version:             blockVersion,
+		PrevBlockHash:       prevBlockHash,
+		RecordsRoot:         MerkleRoot(records),
+		PkiRootHash:         pkiRootHash,
+		DirectTrustRootHash: directTrustRootHash,
+		CompTrustRootHash:   compTrustRootHash,
+		Timestamp:           time.Now().Unix(),
 	}
 }
 
-func (b *Block) prepareData() []byte {
+func (b *Block) Header() *BlockHeader {
+	return &b.BlockHeader
+}
+
+func (h *BlockHeader) prepareData() []byte {
 	data := bytes.Join(
 		[][]byte{
-			b.PrevBlockHash,
-			[]byte(strings.Join(b.Records, ";")),
-			intToHex(b.Timestamp),
-			intToHex(int64(targetBits)),
-			intToHex(int64(b.Nonce)),
+			intToHex(int64(h.Version)),
+			h.PrevBlockHash,
+			h.RecordsRoot,
+			h.PkiRootHash.Bytes(),
+			h.DirectTrustRootHash.Bytes(),
+			h.CompTrustRootHash.Bytes(),
+			intToHex(h.Timestamp),
+			intToHex(int64(h.TargetBits)),
+			intToHex(int64(h.Nonce)),
+			[]byte(h.Proposer),
 		},
 		[]byte{},
 	)
@@ -69,6 +75,31 @@ func (b *Block) prepareData() []byte {
 	return data
 }
 
+func (h *BlockHeader) hash() [32]byte {
+	return sha256.Sum256(h.prepareData())
+}
+
+// Hash recomputes the hash of the header.
+func (h *BlockHeader) Hash() []byte {
+	hash := h.hash()
+	return hash[:]
+}
+
+// Validate checks that the block's hash commits to its header and that the
+// header commits to its records. Consensus fields are checked by the engine.
+func (b *Block) Validate() error {
+	if b.Version != blockVersion {
+		return fmt.Errorf("unsupported block version %d", b.Version)
+	}
+	if !bytes.Equal(b.RecordsRoot, MerkleRoot(b.Records)) {
+		return errors.New("records root mismatch")
+	}
+	if !bytes.Equal(b.Hash, b.Header().Hash()) {
+		return errors.New("block hash mismatch")
+	}
+	return nil
+}
+
 func intToHex(num int64) []byte {
 	buff := new(bytes.Buffer)
 	err := binary.Write(buff, binary.BigEndian, num)
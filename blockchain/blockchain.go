@@ -2,172 +2,291 @@ package blockchain
 
 import (
 	"bytes"
-	"crypto/sha256"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/duanjr/trustchain/mempool"
+	"github.com/duanjr/trustchain/record"
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/trie"
 	"log"
-	"math"
-	"strconv"
+	"sync"
 )
 
 type Blockchain struct {
-	Blocks          []*Block
-	memPool         []string
-	PkiTrie         *trie.Trie
-	DirectTrustTrie *trie.Trie
-	CompTrustTrie   *trie.Trie
-	Id2DT           map[string]map[string]float64
-	c               float64
-	AddressList     *[]string
-}
-
-const memPoolCapacity = 30001
-
-func NewBlockchain() *Blockchain {
-	pkiMemdb := memorydb.New()
-	pkiTrie, _ := trie.New(common.Hash{}, trie.NewDatabase(pkiMemdb))
-	directTrustMemdb := memorydb.New()
-	directTrustTrie, _ := trie.New(common.Hash{}, trie.NewDatabase(directTrustMemdb))
-	compTrustMemdb := memorydb.New()
-	compTrustTrie, _ := trie.New(common.Hash{}, trie.NewDatabase(compTrustMemdb))
-	return &Blockchain{
-		Blocks:          []*Block{newGenesisBlock()},
-		memPool:         []string{},
-		PkiTrie:         pkiTrie,
-		DirectTrustTrie: directTrustTrie,
-		CompTrustTrie:   compTrustTrie,
-		Id2DT:           make(map[string]map[string]float64),
-		c:               1,
-		AddressList:     new([]string),
-	}
-}
-
-func NewBlockchainWithBlocks(newBlocks []*Block) *Blockchain {
-	pkiMemdb := memorydb.New()
-	pkiTrie, _ := trie.New(common.Hash{}, trie.NewDatabase(pkiMemdb))
-	directTrustMemdb := memorydb.New()
-	directTrustTrie, _ := trie.New(common.Hash{}, trie.NewDatabase(directTrustMemdb))
-	compTrustMemdb := memorydb.New()
-	compTrustTrie, _ := trie.New(common.Hash{}, trie.NewDatabase(compTrustMemdb))
-	return &Blockchain{
-		Blocks:          newBlocks,
-		memPool:         []string{},
-		PkiTrie:         pkiTrie,
-		DirectTrustTrie: directTrustTrie,
-		CompTrustTrie:   compTrustTrie,
-		Id2DT:           make(map[string]map[string]float64),
-		c:               1,
-		AddressList:     new([]string),
-	}
+	*State
+	Blocks   []*Block
+	pool     *mempool.Pool
+	index    map[string]*blockNode
+	engine   Engine
+	trust    TrustParams
+	producer ProducerConfig
+	sealing  *SealJob
+	db       ethdb.KeyValueStore
+	trieDb   *trie.Database
+	commitMu sync.Mutex
 }
 
-func newGenesisBlock() *Block {
-	return newBlock([]string{"Genesis Block"}, []byte{}, common.Hash{}, common.Hash{}, common.Hash{})
-}
+// NewBlockchain opens the chain stored in db, starting it from spec if db is
+// empty. A stored chain must start from spec too, unless spec is nil, in
+// which case DefaultGenesis is used and any stored chain accepted.
+func NewBlockchain(db ethdb.KeyValueStore, engine Engine, spec *Genesis, trust TrustParams) (*Blockchain, error) {
+	strict := spec != nil
+	if spec == nil {
+		spec = DefaultGenesis()
+	}
+	headHash := readLastBlockHash(db)
+	if headHash == nil {
+		genesis, err := spec.commit(db, trust)
+		if err != nil {
+			return nil, err
+		}
+		headHash = genesis.Hash
+	}
+
+	blocks, err := readAllBlocks(db)
+	if err != nil {
+		return nil, err
+	}
+	genesis := blocks[hex.EncodeToString(headHash)]
+	for genesis != nil && len(genesis.PrevBlockHash) > 0 {
+		genesis = blocks[hex.EncodeToString(genesis.PrevBlockHash)]
+	}
+	if genesis == nil {
+		return nil, errors.New("missing blocks between head and genesis")
+	}
+	if strict {
+		want, err := spec.Block(trust)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(genesis.Hash, want.Hash) {
+			return nil, fmt.Errorf("database holds a chain from genesis %x, not %x", genesis.Hash, want.Hash)
+		}
+	}
 
-func (bc *Blockchain) AddBlock(records []string) {
-	prevBlock := bc.Blocks[len(bc.Blocks)-1]
-	newBlock := newBlock(records, prevBlock.Hash, bc.PkiTrie.Hash(), bc.DirectTrustTrie.Hash(), bc.CompTrustTrie.Hash())
-	bc.Blocks = append(bc.Blocks, newBlock)
+	bc := newBlockchain(db, engine, trust)
+	bc.indexBlocks(genesis, blocks)
+	head := bc.getNode(headHash)
+	state, err := bc.loadState(head)
+	if err != nil {
+		return nil, err
+	}
+	bc.State = state
+	bc.Blocks = head.path()
+	bc.confirmChain()
+	return bc, nil
 }
 
-func (bc *Blockchain) AddRecord(record string) {
-	bc.memPool = append(bc.memPool, record)
+func newBlockchain(db ethdb.KeyValueStore, engine Engine, trust TrustParams) *Blockchain {
+	return &Blockchain{
+		pool:   mempool.New(mempool.DefaultConfig),
+		index:  make(map[string]*blockNode),
+		engine: engine,
+		trust:  trust,
+		db:     db,
+		trieDb: trie.NewDatabase(db),
+	}
+}
 
-	if len(bc.memPool) >= memPoolCapacity {
-		bc.minePendingRecords()
+// AddBlock seals a block of records on top of the head and adds it to the
+// chain. Records that are invalid on the head's state are left out.
+func (bc *Blockchain) AddBlock(records []*record.Record) error {
+	job, err := bc.newSealJob(context.Background(), records)
+	if err != nil {
+		return err
 	}
+	if err := job.Seal(); err != nil {
+		return err
+	}
+	return bc.insertSealed(job)
 }
 
-func (bc *Blockchain) minePendingRecords() {
-	bc.CalculateAllCompTrust()
-	prevBlock := bc.Blocks[len(bc.Blocks)-1]
-	newBlock := newBlock(bc.memPool, prevBlock.Hash, bc.PkiTrie.Hash(), bc.DirectTrustTrie.Hash(), bc.CompTrustTrie.Hash())
-	bc.Blocks = append(bc.Blocks, newBlock)
+// SetMempool replaces the mempool with an empty one using cfg.
+func (bc *Blockchain) SetMempool(cfg mempool.Config) {
+	pending := bc.pool.Pending()
+	bc.pool = mempool.New(cfg)
+	bc.confirmChain()
+	bc.rebuildPending(pending)
+}
 
-	bc.memPool = []string{}
+// Mempool returns the pending records by priority.
+func (bc *Blockchain) Mempool() []*mempool.Entry {
+	return bc.pool.Entries()
 }
 
-func (bc *Blockchain) IsValid() bool {
-	for i := 1; i < len(bc.Blocks); i++ {
-		currentBlock := bc.Blocks[i]
-		prevBlock := bc.Blocks[i-1]
+// MempoolCapacity returns the number of records the mempool holds at most.
+func (bc *Blockchain) MempoolCapacity() int {
+	return bc.pool.Capacity()
+}
 
-		hash := sha256.Sum256(currentBlock.prepareData())
-		if !bytes.Equal(currentBlock.Hash, hash[:]) {
-			return false
-		}
+// AddRecord admits a record whose signatures were verified to the mempool if
+// it is valid on the current state, and applies it to the state. It is the
+// only way records enter the state outside of blocks. Signatures are left to
+// the caller so that they can be checked without holding the chain.
+func (bc *Blockchain) AddRecord(r *record.Record) error {
+	return bc.admit(r)
+}
 
-		if !bytes.Equal(currentBlock.PrevBlockHash, prevBlock.Hash) {
-			return false
-		}
+// admit adds a verified record to the mempool and applies it to the state.
+// If records are evicted to make room for it, the state is rebuilt from the
+// records still pending, so that it holds no effect of the evicted ones.
+func (bc *Blockchain) admit(r *record.Record) error {
+	if err := bc.pool.Validate(r); err != nil {
+		return err
 	}
-	return true
+	if err := bc.State.apply(r); err != nil {
+		return err
+	}
+	if evicted := bc.pool.Add(r); len(evicted) > 0 {
+		bc.rebuildPending(bc.pool.Pending())
+	}
+	return nil
 }
 
-func (bc *Blockchain) CompTrust(addressI string, addressJ string) float64 {
-	DT, ok := bc.Id2DT[addressI][addressJ]
-	if !ok {
-		return 0
+// PendingRecords returns the records not yet in a block, including those of
+// a block being sealed.
+func (bc *Blockchain) PendingRecords() []*record.Record {
+	var records []*record.Record
+	if bc.sealing != nil {
+		records = append(records, bc.sealing.selected...)
 	}
+	return append(records, bc.pool.Pending()...)
+}
 
-	iT := 0.0
-	m := 0
-	DtSum := 0.0
+// RestorePendingRecords re-applies records left over from another chain,
+// keeping in the mempool those still valid on top of this chain's state.
+// The records were verified when they entered the mempool or a block.
+func (bc *Blockchain) RestorePendingRecords(records []*record.Record) {
+	for _, r := range records {
+		bc.admit(r)
+	}
+}
 
-	for k, DtIk := range bc.Id2DT[addressI] {
-		if k != addressJ && DtIk > 0 {
-			m++
-			DtSum += DtIk
-			DtKj, ok := bc.Id2DT[k][addressJ]
-			if ok {
-				iT += DtIk * DtKj
-			}
+// rebuildPending resets the state to the head's, with the records of a
+// block being sealed applied, and re-admits records, after records the state
+// included left the mempool.
+func (bc *Blockchain) rebuildPending(records []*record.Record) {
+	state, err := bc.loadState(bc.head())
+	if err != nil {
+		log.Printf("Error loading head state: %v", err)
+		return
+	}
+	if bc.sealing != nil {
+		for _, r := range bc.sealing.selected {
+			state.apply(r)
 		}
 	}
-	if m > 0 {
-		iT /= DtSum
+	bc.State = state
+	bc.pool.Reset()
+	bc.RestorePendingRecords(records)
+}
+
+// confirmChain tells the mempool which nonces the canonical chain used.
+func (bc *Blockchain) confirmChain() {
+	bc.pool.ResetConfirmed()
+	for _, block := range bc.Blocks {
+		bc.pool.Confirm(block.Records)
 	}
+}
 
-	alpha := 0.0
-	mu := 0.0
-	sigma := 0.0
+// newSealJob prepares a block of records on top of the head. Its state is
+// built when it is sealed.
+func (bc *Blockchain) newSealJob(ctx context.Context, records []*record.Record) (*SealJob, error) {
+	parent := bc.head()
+	header := newHeader(nil, parent.block.Hash, common.Hash{}, common.Hash{}, common.Hash{})
+	if err := bc.engine.Prepare(bc, header); err != nil {
+		return nil, err
+	}
 
-	for k, DtIk := range bc.Id2DT[addressI] {
-		if k != addressJ && DtIk > 0 {
-			m++
-			DtKj, ok := bc.Id2DT[k][addressJ]
-			if !ok {
-				DtKj = 0
-			}
-			sigma += (DtKj - iT) * (DtKj - iT)
+	ctx, cancel := context.WithCancel(ctx)
+	return &SealJob{
+		ctx:      ctx,
+		cancel:   cancel,
+		chain:    bc,
+		engine:   bc.engine,
+		parent:   parent,
+		header:   header,
+		selected: records,
+	}, nil
+}
+
+// takeRecords removes a job's records from the mempool and makes the job's
+// state, with the remaining records applied, the current state.
+func (bc *Blockchain) takeRecords(job *SealJob) {
+	bc.pool.Remove(job.selected)
+	pending := bc.pool.Pending()
+	bc.pool.Reset()
+	bc.State = job.state
+	bc.RestorePendingRecords(pending)
+}
+
+// commitState flushes a state's tries to the trie database. Blocks are
+// sealed outside the caller's lock, so commits are serialized here.
+func (bc *Blockchain) commitState(state *State) ([3]common.Hash, error) {
+	bc.commitMu.Lock()
+	defer bc.commitMu.Unlock()
+	return state.commit(bc.trieDb)
+}
+
+func (bc *Blockchain) insertSealed(job *SealJob) error {
+	batch := bc.db.NewBatch()
+	if err := writeBlock(batch, job.block); err != nil {
+		return err
+	}
+	if storesStateMeta(job.parent.height + 1) {
+		if err := writeStateMeta(batch, job.block.Hash, job.state.meta()); err != nil {
+			return err
 		}
 	}
-
-	mu = float64(m) / (float64(m) + bc.c)
-	if m > 0 {
-		sigma = math.Sqrt(sigma / float64(m))
-		sigma = 1 / (1 + sigma)
+	if err := writeLastBlockHash(batch, job.block.Hash); err != nil {
+		return err
+	}
+	if err := batch.Write(); err != nil {
+		return err
 	}
 
-	alpha = (mu + sigma) / 4
+	bc.addNode(job.block, job.parent)
+	bc.Blocks = append(bc.Blocks, job.block)
+	bc.pool.Confirm(job.block.Records)
+	bc.takeRecords(job)
+	return nil
+}
 
-	result := (1-alpha)*DT + alpha*iT
+// ProposeBlock prepares a block of the pending records on top of the head
+// without adding it to the chain, for engines that agree on a block before
+// committing it. The job is sealed without holding the chain.
+func (bc *Blockchain) ProposeBlock() (*SealJob, error) {
+	records := bc.pool.Select(bc.producer.MaxRecords, bc.producer.MaxBytes)
+	return bc.newSealJob(context.Background(), records)
+}
 
-	return result
+// GetBlock returns a known block by hash, whether canonical or not.
+func (bc *Blockchain) GetBlock(hash []byte) *Block {
+	if node := bc.getNode(hash); node != nil {
+		return node.block
+	}
+	return nil
 }
 
-func (bc *Blockchain) CalculateAllCompTrust() {
-	for _, i := range *bc.AddressList {
-		for _, j := range *bc.AddressList {
-			if i != j {
-				compTrust := bc.CompTrust(i, j)
-				err := bc.CompTrustTrie.TryUpdate([]byte(i+"&"+j), []byte(strconv.FormatFloat(compTrust, 'f', 6, 64)))
-				if err != nil {
-					log.Fatalf("Error updating CompTrustTrie: %v", err)
-				}
-			}
+func (bc *Blockchain) IsValid() bool {
+	for i := 0; i < len(bc.Blocks); i++ {
+		currentBlock := bc.Blocks[i]
+		if err := currentBlock.Validate(); err != nil {
+			return false
+		}
+
+		if i == 0 {
+			continue
+		}
+		if !bytes.Equal(currentBlock.PrevBlockHash, bc.Blocks[i-1].Hash) {
+			return false
+		}
+		if err := bc.engine.VerifyHeader(bc, currentBlock.Header()); err != nil {
+			return false
 		}
 	}
+	return true
 }
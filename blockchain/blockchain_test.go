@@ -0,0 +1,150 @@
+package blockchain
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"github.com/duanjr/trustchain/mempool"
+	"github.com/duanjr/trustchain/record"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"math/big"
+	"reflect"
+	"testing"
+)
+
+// testEngine seals every header as is and weighs every block the same.
+type testEngine struct{}
+
+func (testEngine) Prepare(ChainReader, *BlockHeader) error      { return nil }
+func (testEngine) Seal(context.Context, *BlockHeader) error     { return nil }
+func (testEngine) VerifyHeader(ChainReader, *BlockHeader) error { return nil }
+func (testEngine) Proposer(int) string                          { return "" }
+func (testEngine) Work(*BlockHeader) *big.Int                   { return big.NewInt(1) }
+func (testEngine) Finalized(*BlockHeader) bool                  { return false }
+
+func newTestKey(t testing.TB) (*ecdsa.PrivateKey, string) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, record.SignerAddress(crypto.FromECDSAPub(&key.PublicKey))
+}
+
+func newTrustSubmit(t testing.TB, key *ecdsa.PrivateKey, from, to string, value float64, timestamp uint64) *record.Record {
+	r := record.NewTrustSubmit(from, to, value, nil, nil, timestamp)
+	if err := r.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestReopenRebuildsDirectTrust(t *testing.T) {
+	db := memorydb.New()
+	bc, err := NewBlockchain(db, testEngine{}, nil, DefaultTrustParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, from := newTestKey(t)
+	_, to := newTestKey(t)
+	if err := bc.ApplyRecord(newTrustSubmit(t, key, from, to, 1, 1)); err == nil {
+		t.Error("trust submission from an unregistered address accepted")
+	}
+	register := record.NewPKIRegister(from, nil, nil, 0)
+	if err := register.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.AddBlock([]*record.Record{register}); err != nil {
+		t.Fatal(err)
+	}
+	var last *record.Record
+	for i := 1; i <= stateMetaInterval+3; i++ {
+		value := float64(i%10) / 10
+		last = newTrustSubmit(t, key, from, to, value, uint64(i))
+		if err := bc.AddBlock([]*record.Record{last}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reopened, err := NewBlockchain(db, testEngine{}, nil, DefaultTrustParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reopened.Id2DT, bc.Id2DT) || !reflect.DeepEqual(*reopened.AddressList, *bc.AddressList) {
+		t.Errorf("reopened direct trust %v, want %v", reopened.Id2DT, bc.Id2DT)
+	}
+	if reopened.CompTrustTrie.Hash() != bc.CompTrustTrie.Hash() {
+		t.Error("reopened composite trust differs")
+	}
+	if err := reopened.ApplyRecord(last); err == nil {
+		t.Error("reopened state accepted a replayed trust submission")
+	}
+}
+
+func TestVerifyRecordProof(t *testing.T) {
+	var records []*record.Record
+	for i := 0; i < 5; i++ {
+		records = append(records, record.NewData([]byte{byte(i)}, uint64(i+1), 0))
+	}
+	header := newHeader(records, nil, common.Hash{}, common.Hash{}, common.Hash{})
+	block := &Block{BlockHeader: *header, Records: records}
+
+	for i, r := range records {
+		proof, err := block.RecordProof(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyRecordProof(header, r, proof); err != nil {
+			t.Errorf("proof of record %d rejected: %v", i, err)
+		}
+	}
+
+	proof, _ := block.RecordProof(1)
+	for name, tamper := range map[string]func(p *MerkleProof){
+		"another index":  func(p *MerkleProof) { p.Index = 0 },
+		"a flipped side": func(p *MerkleProof) { p.Path[0].Left = !p.Path[0].Left },
+		"a short path":   func(p *MerkleProof) { p.Path = p.Path[:len(p.Path)-1] },
+		"a long path":    func(p *MerkleProof) { p.Path = append(p.Path, p.Path[0]) },
+	} {
+		tampered := *proof
+		tampered.Path = append([]MerkleStep{}, proof.Path...)
+		tamper(&tampered)
+		if err := VerifyRecordProof(header, records[1], &tampered); err == nil {
+			t.Errorf("proof with %s accepted", name)
+		}
+	}
+}
+
+func TestEvictedRecordLeavesState(t *testing.T) {
+	bc, err := NewBlockchain(memorydb.New(), testEngine{}, nil, DefaultTrustParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	register := func(key *ecdsa.PrivateKey, address string) *record.Record {
+		r := record.NewPKIRegister(address, nil, nil, 0)
+		if err := r.Sign(key); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	key, from := newTestKey(t)
+	_, to := newTestKey(t)
+	if err := bc.AddBlock([]*record.Record{register(key, from)}); err != nil {
+		t.Fatal(err)
+	}
+	bc.SetMempool(mempool.Config{Capacity: 1})
+
+	if err := bc.AddRecord(newTrustSubmit(t, key, from, to, 0.5, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := bc.Id2DT[from][to]; !ok {
+		t.Fatal("pending trust submission not applied")
+	}
+	other, otherAddress := newTestKey(t)
+	if err := bc.AddRecord(register(other, otherAddress)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := bc.Id2DT[from][to]; ok {
+		t.Error("evicted trust submission still applied")
+	}
+}
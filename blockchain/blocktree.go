@@ -0,0 +1,272 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/duanjr/trustchain/record"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/trie"
+	"math/big"
+	"time"
+)
+
+var (
+	ErrUnknownParent = errors.New("unknown parent block")
+	// ErrInvalidBlock wraps the errors that prove a block invalid, as opposed
+	// to those that only show it cannot be checked here yet.
+	ErrInvalidBlock = errors.New("invalid block")
+	// ErrFutureBlock is returned for blocks stamped ahead of the local clock
+	// by more than is allowed, which may be valid once the clock catches up.
+	ErrFutureBlock = errors.New("block timestamp too far in the future")
+)
+
+// blockNode is an entry in the tree of every known block, canonical or not.
+type blockNode struct {
+	block     *Block
+	parent    *blockNode
+	height    int
+	totalWork *big.Int
+}
+
+const maxFutureBlockTime = 2 * 60 * 60
+
+func (bc *Blockchain) addNode(block *Block, parent *blockNode) *blockNode {
+	node := &blockNode{block: block, parent: parent, totalWork: bc.engine.Work(block.Header())}
+	if parent != nil {
+		node.height = parent.height + 1
+		node.totalWork.Add(node.totalWork, parent.totalWork)
+	}
+	bc.index[hex.EncodeToString(block.Hash)] = node
+	return node
+}
+
+func (bc *Blockchain) getNode(hash []byte) *blockNode {
+	return bc.index[hex.EncodeToString(hash)]
+}
+
+func (bc *Blockchain) head() *blockNode {
+	return bc.getNode(bc.Blocks[len(bc.Blocks)-1].Hash)
+}
+
+// indexBlocks adds every stored block descending from genesis to the tree.
+func (bc *Blockchain) indexBlocks(genesis *Block, blocks map[string]*Block) {
+	children := make(map[string][]*Block)
+	for _, block := range blocks {
+		parent := hex.EncodeToString(block.PrevBlockHash)
+		children[parent] = append(children[parent], block)
+	}
+
+	queue := []*blockNode{bc.addNode(genesis, nil)}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		for _, child := range children[hex.EncodeToString(node.block.Hash)] {
+			queue = append(queue, bc.addNode(child, node))
+		}
+	}
+}
+
+func (node *blockNode) path() []*Block {
+	blocks := make([]*Block, node.height+1)
+	for n := node; n != nil; n = n.parent {
+		blocks[n.height] = n.block
+	}
+	return blocks
+}
+
+// Finalized reports whether the canonical chain holds a block its engine
+// considers final.
+func (bc *Blockchain) Finalized() bool {
+	for i := len(bc.Blocks) - 1; i > 0; i-- {
+		if bc.engine.Finalized(bc.Blocks[i].Header()) {
+			return true
+		}
+	}
+	return false
+}
+
+// TotalWork returns the cumulative proof-of-work of the canonical chain.
+func (bc *Blockchain) TotalWork() *big.Int {
+	return new(big.Int).Set(bc.head().totalWork)
+}
+
+// loadState opens the state of a known block. The direct trust matrix and
+// the record sequences are only stored every stateMetaInterval blocks, so
+// those of the blocks since the last stored one are rebuilt from their
+// records. It only reads the
+// database and the block tree above node, which never changes, so it is safe
+// without holding the chain.
+func (bc *Blockchain) loadState(node *blockNode) (*State, error) {
+	var replay []*Block
+	meta, err := readStateMeta(bc.db, node.block.Hash)
+	for n := node; err == errNotFound && n.parent != nil; n = n.parent {
+		replay = append(replay, n.block)
+		meta, err = readStateMeta(bc.db, n.parent.block.Hash)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := openState(bc.trieDb, node.block.Header(), meta, bc.trust)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(replay) - 1; i >= 0; i-- {
+		if err := state.replay(replay[i]); err != nil {
+			return nil, err
+		}
+	}
+	return state, nil
+}
+
+// InsertBlock validates a block against the state of its parent and adds it
+// to the block tree. If the branch it extends now carries more cumulative
+// work than the canonical chain, the chain is reorganized onto it.
+func (bc *Blockchain) InsertBlock(block *Block) error {
+	if bc.getNode(block.Hash) != nil {
+		return nil
+	}
+	if err := bc.VerifyHeader(block); err != nil {
+		return err
+	}
+	return bc.InsertVerifiedBlock(block)
+}
+
+// VerifyHeader checks a block's hash and records root, and its consensus
+// fields against its parent. It only reads the block tree and committed
+// state, so it may run while the chain is held for reading.
+func (bc *Blockchain) VerifyHeader(block *Block) error {
+	if err := block.Validate(); err != nil {
+		return invalid(err)
+	}
+	if err := bc.engine.VerifyHeader(bc, block.Header()); err != nil {
+		if errors.Is(err, ErrUnknownParent) || errors.Is(err, ErrMissingState) || errors.Is(err, ErrFutureBlock) {
+			return err
+		}
+		return invalid(err)
+	}
+	return nil
+}
+
+// InsertVerifiedBlock is InsertBlock for a block that passed VerifyHeader.
+func (bc *Blockchain) InsertVerifiedBlock(block *Block) error {
+	if bc.getNode(block.Hash) != nil {
+		return nil
+	}
+	parent, state, err := bc.executeBlock(block)
+	if err != nil {
+		return err
+	}
+	if _, err := bc.commitState(state); err != nil {
+		return err
+	}
+
+	batch := bc.db.NewBatch()
+	if err := writeBlock(batch, block); err != nil {
+		return err
+	}
+	if storesStateMeta(parent.height + 1) {
+		if err := writeStateMeta(batch, block.Hash, state.meta()); err != nil {
+			return err
+		}
+	}
+	if err := batch.Write(); err != nil {
+		return err
+	}
+
+	node := bc.addNode(block, parent)
+	if bc.sealing != nil && node.height > bc.sealing.parent.height {
+		bc.abortSealing()
+	}
+	if node.totalWork.Cmp(bc.head().totalWork) > 0 {
+		return bc.setHead(node, state)
+	}
+	return nil
+}
+
+// VerifyBlock checks a block against the state of its parent without adding
+// it to the block tree. Its consensus fields are left to the engine.
+func (bc *Blockchain) VerifyBlock(block *Block) error {
+	if err := block.Validate(); err != nil {
+		return invalid(err)
+	}
+	_, _, err := bc.executeBlock(block)
+	return err
+}
+
+// executeBlock applies a block's records to the state of its parent.
+func (bc *Blockchain) executeBlock(block *Block) (*blockNode, *State, error) {
+	parent := bc.getNode(block.PrevBlockHash)
+	if parent == nil {
+		return nil, nil, ErrUnknownParent
+	}
+	if block.Timestamp > time.Now().Unix()+maxFutureBlockTime {
+		return nil, nil, ErrFutureBlock
+	}
+
+	state, err := bc.loadState(parent)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := state.applyBlock(block); err != nil {
+		var missing *trie.MissingNodeError
+		if errors.As(err, &missing) {
+			return nil, nil, err
+		}
+		return nil, nil, invalid(err)
+	}
+	return parent, state, nil
+}
+
+func invalid(err error) error {
+	return fmt.Errorf("%w: %v", ErrInvalidBlock, err)
+}
+
+// setHead makes node the canonical head with the given state. Records of
+// blocks leaving the canonical chain are returned to the mempool together
+// with the pending records, keeping those still valid on the new state.
+func (bc *Blockchain) setHead(node *blockNode, state *State) error {
+	bc.abortSealing()
+	oldChain := bc.Blocks
+	newChain := node.path()
+
+	fork := 0
+	for fork < len(oldChain) && fork < len(newChain) && bytes.Equal(oldChain[fork].Hash, newChain[fork].Hash) {
+		fork++
+	}
+	for _, block := range oldChain[fork:] {
+		if bc.engine.Finalized(block.Header()) {
+			return errors.New("reorganization past finalized block")
+		}
+	}
+
+	included := make(map[common.Hash]bool)
+	for _, block := range newChain[fork:] {
+		for _, r := range block.Records {
+			included[r.Hash()] = true
+		}
+	}
+	var pending []*record.Record
+	for _, block := range oldChain[fork:] {
+		pending = append(pending, block.Records...)
+	}
+	pending = append(pending, bc.pool.Pending()...)
+	var orphaned []*record.Record
+	for _, r := range pending {
+		if !included[r.Hash()] {
+			orphaned = append(orphaned, r)
+		}
+	}
+
+	if err := writeLastBlockHash(bc.db, node.block.Hash); err != nil {
+		return err
+	}
+	bc.State = state
+	bc.Blocks = newChain
+	bc.pool.Reset()
+	bc.confirmChain()
+	bc.RestorePendingRecords(orphaned)
+	return nil
+}
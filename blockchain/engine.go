@@ -0,0 +1,60 @@
+package blockchain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/trie"
+	"math/big"
+)
+
+// ErrMissingState is returned for lookups in the state of a header whose
+// block has not been executed, such as one fetched ahead of its body.
+var ErrMissingState = errors.New("state not available")
+
+// Engine seals and verifies the consensus fields of block headers. The
+// implementations live in the consensus package, which re-exports this
+// interface as consensus.Engine.
+type Engine interface {
+	// Prepare sets the consensus fields of a header about to be sealed on
+	// top of its parent, failing if this node may not seal it.
+	Prepare(chain ChainReader, header *BlockHeader) error
+	// Seal completes a prepared header so that it passes VerifyHeader,
+	// giving up when ctx is done.
+	Seal(ctx context.Context, header *BlockHeader) error
+	// VerifyHeader checks the consensus fields of a header against its parent.
+	VerifyHeader(chain ChainReader, header *BlockHeader) error
+	// Proposer returns the identity expected to seal the block at height, or
+	// "" if anyone may.
+	Proposer(height int) string
+	// Work returns the weight a header adds to its branch for fork choice.
+	Work(header *BlockHeader) *big.Int
+	// Finalized reports whether a verified header can no longer be
+	// reorganized out of the chain.
+	Finalized(header *BlockHeader) bool
+}
+
+// ChainReader gives engines access to known headers and their state.
+type ChainReader interface {
+	// GetHeader returns a known header and its height, or nil.
+	GetHeader(hash []byte) (*BlockHeader, int)
+	// PKIKey returns the public key registered for address in the state
+	// committed by header, or ErrMissingState if that state is not known.
+	PKIKey(header *BlockHeader, address string) ([]byte, error)
+}
+
+func (bc *Blockchain) GetHeader(hash []byte) (*BlockHeader, int) {
+	node := bc.getNode(hash)
+	if node == nil {
+		return nil, 0
+	}
+	return node.block.Header(), node.height
+}
+
+func (bc *Blockchain) PKIKey(header *BlockHeader, address string) ([]byte, error) {
+	t, err := trie.New(header.PkiRootHash, bc.trieDb)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMissingState, err)
+	}
+	return t.TryGet([]byte(address))
+}
@@ -0,0 +1,154 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/duanjr/trustchain/record"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/ethereum/go-ethereum/trie"
+	"strings"
+)
+
+const genesisTargetBits = 16
+
+// Genesis describes the genesis block and the state it starts the chain
+// with. Nodes built from the same Genesis have the same genesis block.
+type Genesis struct {
+	Timestamp int64 `json:"timestamp"`
+	// TargetBits is the proof-of-work difficulty of the first blocks.
+	TargetBits int               `json:"targetBits"`
+	Identities []GenesisIdentity `json:"identities"`
+	Trust      []GenesisTrust    `json:"trust"`
+	// Params is the canonical encoding of the network parameters fixed along
+	// with the genesis state. The genesis block commits to it, so nodes that
+	// disagree on them have different genesis blocks.
+	Params []byte `json:"-"`
+}
+
+// GenesisIdentity is a public key registered in the PKI from the start.
+type GenesisIdentity struct {
+	Address   string `json:"address"`
+	PublicKey string `json:"publicKey"`
+}
+
+// GenesisTrust is a direct trust value between two addresses from the start.
+type GenesisTrust struct {
+	From  string  `json:"from"`
+	To    string  `json:"to"`
+	Value float64 `json:"value"`
+}
+
+// DefaultGenesis is the genesis of chains started without a genesis file.
+func DefaultGenesis() *Genesis {
+	return &Genesis{TargetBits: genesisTargetBits}
+}
+
+// Validate checks g without building its state.
+func (g *Genesis) Validate() error {
+	if g.TargetBits < 0 || g.TargetBits > 255 {
+		return fmt.Errorf("invalid genesis target bits %d", g.TargetBits)
+	}
+	registered := make(map[string]bool)
+	for _, id := range g.Identities {
+		if id.Address == "" {
+			return errors.New("genesis identity without address")
+		}
+		if registered[strings.ToLower(id.Address)] {
+			return errors.New("address " + id.Address + " registered twice")
+		}
+		registered[strings.ToLower(id.Address)] = true
+		key, err := decodePublicKey(id.PublicKey)
+		if err != nil {
+			return fmt.Errorf("invalid public key of %s: %v", id.Address, err)
+		}
+		if !strings.EqualFold(record.SignerAddress(key), id.Address) {
+			return fmt.Errorf("public key of %s has address %s", id.Address, record.SignerAddress(key))
+		}
+	}
+	for _, t := range g.Trust {
+		if t.From == "" || t.To == "" || t.From == t.To {
+			return fmt.Errorf("invalid genesis trust from %q to %q", t.From, t.To)
+		}
+		if !registered[strings.ToLower(t.From)] || !registered[strings.ToLower(t.To)] {
+			return fmt.Errorf("genesis trust from %s to %s between undeclared identities", t.From, t.To)
+		}
+		if t.Value > 1 || t.Value < -1 {
+			return fmt.Errorf("invalid genesis trust value %v", t.Value)
+		}
+	}
+	return nil
+}
+
+func decodePublicKey(publicKey string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimPrefix(publicKey, "0x"))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := crypto.UnmarshalPubkey(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// build builds the genesis block and its state in trieDb.
+func (g *Genesis) build(trieDb *trie.Database, params TrustParams) (*Block, *State, error) {
+	if err := g.Validate(); err != nil {
+		return nil, nil, err
+	}
+	s, err := openState(trieDb, &BlockHeader{}, &stateMeta{}, params)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Addresses are written in the lowercase form records derive from keys,
+	// so that the genesis state is found by the same lookups.
+	for _, id := range g.Identities {
+		key, _ := decodePublicKey(id.PublicKey)
+		if err := s.PkiTrie.TryUpdate([]byte(strings.ToLower(id.Address)), key); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, t := range g.Trust {
+		s.applyDirectTrust(strings.ToLower(t.From), strings.ToLower(t.To), t.Value)
+	}
+	s.CalculateAllCompTrust()
+
+	records := []*record.Record{record.NewData(append([]byte("Genesis Block"), g.Params...), 0, 0)}
+	header := newHeader(records, []byte{}, s.PkiTrie.Hash(), s.DirectTrustTrie.Hash(), s.CompTrustTrie.Hash())
+	header.Timestamp = g.Timestamp
+	header.TargetBits = g.TargetBits
+	return &Block{BlockHeader: *header, Records: records, Hash: header.Hash()}, s, nil
+}
+
+// Block returns the unsealed genesis block. It is the root every engine
+// builds on and is never checked by one.
+func (g *Genesis) Block(params TrustParams) (*Block, error) {
+	block, _, err := g.build(trie.NewDatabase(memorydb.New()), params)
+	return block, err
+}
+
+// commit writes the genesis block and its state to db.
+func (g *Genesis) commit(db ethdb.KeyValueStore, params TrustParams) (*Block, error) {
+	trieDb := trie.NewDatabase(db)
+	block, s, err := g.build(trieDb, params)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.commit(trieDb); err != nil {
+		return nil, err
+	}
+
+	batch := db.NewBatch()
+	if err := writeBlock(batch, block); err != nil {
+		return nil, err
+	}
+	if err := writeStateMeta(batch, block.Hash, s.meta()); err != nil {
+		return nil, err
+	}
+	if err := writeLastBlockHash(batch, block.Hash); err != nil {
+		return nil, err
+	}
+	return block, batch.Write()
+}
@@ -0,0 +1,55 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/ethereum/go-ethereum/trie"
+	"strings"
+	"testing"
+)
+
+func TestGenesisValidate(t *testing.T) {
+	key, address := newTestKey(t)
+	other, otherAddress := newTestKey(t)
+	identity := func(address string, key []byte) GenesisIdentity {
+		return GenesisIdentity{Address: address, PublicKey: hex.EncodeToString(key)}
+	}
+	publicKey := crypto.FromECDSAPub(&key.PublicKey)
+	otherKey := crypto.FromECDSAPub(&other.PublicKey)
+
+	valid := &Genesis{
+		Identities: []GenesisIdentity{identity(strings.ToUpper(address[2:]), publicKey), identity(otherAddress, otherKey)},
+		Trust:      []GenesisTrust{{From: "0x" + strings.ToUpper(address[2:]), To: otherAddress, Value: 0.5}},
+	}
+	valid.Identities[0].Address = "0x" + valid.Identities[0].Address
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("valid genesis rejected: %v", err)
+	}
+	_, s, err := valid.build(trie.NewDatabase(memorydb.New()), DefaultTrustParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if registered, _ := s.PkiTrie.TryGet([]byte(address)); registered == nil {
+		t.Error("genesis identity not registered under its lowercase address")
+	}
+	if _, ok := s.Id2DT[address][otherAddress]; !ok {
+		t.Error("genesis trust not set between lowercase addresses")
+	}
+
+	for name, g := range map[string]*Genesis{
+		"key of another address": {Identities: []GenesisIdentity{identity(address, otherKey)}},
+		"trust from undeclared identity": {
+			Identities: []GenesisIdentity{identity(otherAddress, otherKey)},
+			Trust:      []GenesisTrust{{From: address, To: otherAddress, Value: 0.5}},
+		},
+		"trust to undeclared identity": {
+			Identities: []GenesisIdentity{identity(address, publicKey)},
+			Trust:      []GenesisTrust{{From: address, To: otherAddress, Value: 0.5}},
+		},
+	} {
+		if err := g.Validate(); err == nil {
+			t.Errorf("genesis with %s accepted", name)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"github.com/duanjr/trustchain/record"
+)
+
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+func merkleLeaf(r *record.Record) []byte {
+	hash := sha256.Sum256(append([]byte{merkleLeafPrefix}, r.Bytes()...))
+	return hash[:]
+}
+
+func merkleNode(left, right []byte) []byte {
+	data := make([]byte, 0, 1+len(left)+len(right))
+	data = append(data, merkleNodePrefix)
+	data = append(data, left...)
+	data = append(data, right...)
+	hash := sha256.Sum256(data)
+	return hash[:]
+}
+
+// merkleLevels builds the tree bottom-up. An odd node at the end of a level
+// is promoted to the next level unchanged.
+func merkleLevels(records []*record.Record) [][][]byte {
+	level := make([][]byte, len(records))
+	for i, r := range records {
+		level[i] = merkleLeaf(r)
+	}
+	levels := [][][]byte{level}
+
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 < len(level) {
+				next = append(next, merkleNode(level[i], level[i+1]))
+			} else {
+				next = append(next, level[i])
+			}
+		}
+		levels = append(levels, next)
+		level = next
+	}
+	return levels
+}
+
+// MerkleRoot returns the root of the Merkle tree over a block's records.
+func MerkleRoot(records []*record.Record) []byte {
+	if len(records) == 0 {
+		hash := sha256.Sum256(nil)
+		return hash[:]
+	}
+	levels := merkleLevels(records)
+	return levels[len(levels)-1][0]
+}
+
+type MerkleStep struct {
+	Hash []byte `json:"hash"`
+	Left bool   `json:"left"`
+}
+
+// MerkleProof is the sibling path from a record's leaf to the records root.
+// Index and Count, the number of records in the block, fix which side each
+// sibling is on and at which levels the node is promoted without one.
+type MerkleProof struct {
+	Index int          `json:"index"`
+	Count int          `json:"count"`
+	Path  []MerkleStep `json:"path"`
+}
+
+func merkleProof(records []*record.Record, index int) (*MerkleProof, error) {
+	if index < 0 || index >= len(records) {
+		return nil, errors.New("record index out of range")
+	}
+
+	proof := &MerkleProof{Index: index, Count: len(records), Path: []MerkleStep{}}
+	levels := merkleLevels(records)
+	for _, level := range levels[:len(levels)-1] {
+		if index%2 == 1 {
+			proof.Path = append(proof.Path, MerkleStep{Hash: level[index-1], Left: true})
+		} else if index+1 < len(level) {
+			proof.Path = append(proof.Path, MerkleStep{Hash: level[index+1], Left: false})
+		}
+		index /= 2
+	}
+	return proof, nil
+}
+
+// RecordProof returns the inclusion proof of the record at index.
+func (b *Block) RecordProof(index int) (*MerkleProof, error) {
+	return merkleProof(b.Records, index)
+}
+
+// VerifyRecordProof checks that r is included in the block with the
+// given header. Callers should compare header.Hash() with a block hash they
+// trust before relying on the result.
+func VerifyRecordProof(header *BlockHeader, r *record.Record, proof *MerkleProof) error {
+	if proof == nil {
+		return errors.New("missing proof")
+	}
+
+	if proof.Index < 0 || proof.Index >= proof.Count {
+		return errors.New("record index out of range")
+	}
+
+	hash := merkleLeaf(r)
+	path := proof.Path
+	for index, width := proof.Index, proof.Count; width > 1; index, width = index/2, (width+1)/2 {
+		if index%2 == 0 && index+1 == width {
+			continue
+		}
+		if len(path) == 0 {
+			return errors.New("proof path too short")
+		}
+		step := path[0]
+		path = path[1:]
+		if step.Left != (index%2 == 1) {
+			return errors.New("proof path does not match record index")
+		}
+		if step.Left {
+			hash = merkleNode(step.Hash, hash)
+		} else {
+			hash = merkleNode(hash, step.Hash)
+		}
+	}
+	if len(path) > 0 {
+		return errors.New("proof path too long")
+	}
+	if !bytes.Equal(hash, header.RecordsRoot) {
+		return errors.New("record not included in block")
+	}
+	return nil
+}
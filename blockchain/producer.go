@@ -0,0 +1,163 @@
+package blockchain
+
+import (
+	"context"
+	"github.com/duanjr/trustchain/record"
+	"time"
+)
+
+// ProducerConfig decides when pending records are sealed into a block. A
+// zero limit is not enforced, and the zero config never seals a block.
+type ProducerConfig struct {
+	// Interval is how long after the last block pending records are sealed.
+	Interval time.Duration
+	// MaxRecords and MaxBytes seal a block as soon as the pending records
+	// reach either.
+	MaxRecords int
+	MaxBytes   int
+	// EmptyBlocks seals a block every Interval even with nothing pending.
+	EmptyBlocks bool
+}
+
+// SealJob is a block being sealed without holding the chain. Its records
+// leave the mempool, so that new records are accepted meanwhile, and return
+// to it if the job is aborted. selected are the records it was prepared
+// with, of which records applied to the parent's state.
+type SealJob struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	chain    *Blockchain
+	engine   Engine
+	parent   *blockNode
+	header   *BlockHeader
+	records  []*record.Record
+	selected []*record.Record
+	state    *State
+	block    *Block
+}
+
+// Seal builds the job's state and runs the engine's seal on the job. It is
+// safe to call without holding the chain and returns early once the job is
+// aborted.
+func (job *SealJob) Seal() error {
+	if err := job.build(); err != nil {
+		return err
+	}
+	if err := job.engine.Seal(job.ctx, job.header); err != nil {
+		return err
+	}
+	job.block = &Block{BlockHeader: *job.header, Records: job.records, Hash: job.header.Hash()}
+	return nil
+}
+
+// build applies the selected records to the parent's state, leaving out
+// those that do not apply, and flushes the result to disk. It only reads the
+// chain's database.
+func (job *SealJob) build() error {
+	state, err := job.chain.loadState(job.parent)
+	if err != nil {
+		return err
+	}
+	for _, r := range job.selected {
+		if err := state.ApplyRecord(r); err == nil {
+			job.records = append(job.records, r)
+		}
+	}
+	state.CalculateAllCompTrust()
+	roots, err := job.chain.commitState(state)
+	if err != nil {
+		return err
+	}
+	job.header.RecordsRoot = MerkleRoot(job.records)
+	job.header.PkiRootHash, job.header.DirectTrustRootHash, job.header.CompTrustRootHash = roots[0], roots[1], roots[2]
+	job.state = state
+	return nil
+}
+
+// Block returns the sealed block, or nil before Seal succeeds.
+func (job *SealJob) Block() *Block {
+	return job.block
+}
+
+func (bc *Blockchain) SetProducer(cfg ProducerConfig) {
+	bc.producer = cfg
+}
+
+// PendingSize returns the encoded size of the records in the mempool in
+// bytes.
+func (bc *Blockchain) PendingSize() int {
+	return bc.pool.Size()
+}
+
+func (bc *Blockchain) full() bool {
+	if bc.pool.Len() == 0 {
+		return false
+	}
+	return (bc.producer.MaxRecords > 0 && bc.pool.Len() >= bc.producer.MaxRecords) ||
+		(bc.producer.MaxBytes > 0 && bc.pool.Size() >= bc.producer.MaxBytes)
+}
+
+// NextBlockTime returns when the next block is due, or false if the producer
+// is waiting for records.
+func (bc *Blockchain) NextBlockTime() (time.Time, bool) {
+	if bc.producer.Interval == 0 || (bc.pool.Len() == 0 && !bc.producer.EmptyBlocks) {
+		return time.Time{}, false
+	}
+	last := time.Unix(bc.Blocks[len(bc.Blocks)-1].Timestamp, 0)
+	return last.Add(bc.producer.Interval), true
+}
+
+// StartBlock takes the pending records for a new block if one is due at now
+// and no other is being sealed. It returns nil if there is nothing to do.
+// The current state keeps the records, which the block's state will have
+// too, until the block is added.
+func (bc *Blockchain) StartBlock(ctx context.Context, now time.Time) (*SealJob, error) {
+	if bc.sealing != nil {
+		return nil, nil
+	}
+	due, ok := bc.NextBlockTime()
+	if !bc.full() && (!ok || now.Before(due)) {
+		return nil, nil
+	}
+
+	records := bc.pool.Select(bc.producer.MaxRecords, bc.producer.MaxBytes)
+	job, err := bc.newSealJob(ctx, records)
+	if err != nil {
+		return nil, err
+	}
+	bc.pool.Remove(records)
+	bc.sealing = job
+	return job, nil
+}
+
+// FinishBlock adds the block of a sealed job to the chain. A job that was
+// aborted is dropped, and one that failed returns its records to the mempool.
+func (bc *Blockchain) FinishBlock(job *SealJob, sealErr error) error {
+	if bc.sealing != job {
+		return nil
+	}
+	if sealErr != nil {
+		bc.abortSealing()
+		return sealErr
+	}
+	bc.sealing = nil
+	job.cancel()
+	return bc.insertSealed(job)
+}
+
+// AbortBlock cancels the block being sealed, if any.
+func (bc *Blockchain) AbortBlock() {
+	bc.abortSealing()
+}
+
+// abortSealing cancels the block being sealed and puts its records back in
+// front of the mempool. The state already has them.
+func (bc *Blockchain) abortSealing() {
+	job := bc.sealing
+	if job == nil {
+		return
+	}
+	job.cancel()
+	bc.sealing = nil
+	bc.pool.Restore(job.selected)
+}
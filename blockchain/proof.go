@@ -0,0 +1,123 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+var emptyRoot = common.HexToHash("56e81f171bcc55a6ff8345e692c0f86e5b48e01b996cadc001622fb5e363b421")
+
+// StateProof is a trie Merkle proof for a single key, anchored to the state
+// root committed in a block.
+type StateProof struct {
+	Height    int             `json:"height"`
+	BlockHash hexutil.Bytes   `json:"blockHash"`
+	Root      common.Hash     `json:"root"`
+	Nodes     []hexutil.Bytes `json:"nodes"`
+}
+
+type proofList []hexutil.Bytes
+
+func (l *proofList) Put(key []byte, value []byte) error {
+	*l = append(*l, common.CopyBytes(value))
+	return nil
+}
+
+func (l *proofList) Delete(key []byte) error {
+	return errors.New("delete not supported")
+}
+
+// proveKey opens the trie committed at root and proves key, returning the
+// stored value (nil if absent) along with the proof nodes.
+func (bc *Blockchain) proveKey(root common.Hash, key []byte) ([]byte, []hexutil.Bytes, error) {
+	t, err := trie.New(root, bc.trieDb)
+	if err != nil {
+		return nil, nil, err
+	}
+	value, err := t.TryGet(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	var nodes proofList
+	if err := t.Prove(key, 0, &nodes); err != nil {
+		return nil, nil, err
+	}
+	return value, nodes, nil
+}
+
+func (bc *Blockchain) proveAt(height int, root common.Hash, key []byte) ([]byte, *StateProof, error) {
+	value, nodes, err := bc.proveKey(root, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return value, &StateProof{Height: height, BlockHash: bc.Blocks[height].Hash, Root: root, Nodes: nodes}, nil
+}
+
+// blockHeight resolves a block hash to its height, defaulting to the last
+// block when hash is empty.
+func (bc *Blockchain) blockHeight(hash []byte) (int, error) {
+	if len(hash) == 0 {
+		return len(bc.Blocks) - 1, nil
+	}
+	for i, block := range bc.Blocks {
+		if bytes.Equal(block.Hash, hash) {
+			return i, nil
+		}
+	}
+	return 0, errors.New("no such block")
+}
+
+// ProvePKI proves the public key registered for address in the state of the
+// last block. Records still in the mempool are not covered.
+func (bc *Blockchain) ProvePKI(address string) ([]byte, *StateProof, error) {
+	height := len(bc.Blocks) - 1
+	return bc.proveAt(height, bc.Blocks[height].PkiRootHash, []byte(address))
+}
+
+// ProveDirectTrust proves the direct trust of addressI in addressJ in the
+// state committed by the block with the given hash, or the last block.
+func (bc *Blockchain) ProveDirectTrust(blockHash []byte, addressI, addressJ string) ([]byte, *StateProof, error) {
+	height, err := bc.blockHeight(blockHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bc.proveAt(height, bc.Blocks[height].DirectTrustRootHash, DirectTrustKey(addressI, addressJ))
+}
+
+// ProveCompTrust proves the composite trust of addressI in addressJ in the
+// state committed by the block with the given hash, or the last block.
+func (bc *Blockchain) ProveCompTrust(blockHash []byte, addressI, addressJ string) ([]byte, *StateProof, error) {
+	height, err := bc.blockHeight(blockHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bc.proveAt(height, bc.Blocks[height].CompTrustRootHash, CompTrustKey(addressI, addressJ))
+}
+
+// VerifyStateProof checks proof against its root and returns the value it
+// proves for key, or nil if it proves the key is absent. Callers must check
+// that proof.Root is the root committed in a block header they trust.
+func VerifyStateProof(key []byte, proof *StateProof) ([]byte, error) {
+	if proof == nil {
+		return nil, errors.New("missing proof")
+	}
+	if proof.Root == (common.Hash{}) || proof.Root == emptyRoot {
+		if len(proof.Nodes) != 0 {
+			return nil, errors.New("unexpected proof nodes for empty trie")
+		}
+		return nil, nil
+	}
+
+	db := memorydb.New()
+	for _, node := range proof.Nodes {
+		if err := db.Put(crypto.Keccak256(node), node); err != nil {
+			return nil, err
+		}
+	}
+	return trie.VerifyProof(proof.Root, key, db)
+}
@@ -0,0 +1,312 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/duanjr/trustchain/record"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/trie"
+	"log"
+	"math"
+	"strconv"
+)
+
+// State is the world state derived from the chain: the three tries plus the
+// direct trust matrix the composite trust calculation reads from, and the
+// sequences that keep signed records from being applied twice or out of
+// order.
+type State struct {
+	PkiTrie         *trie.Trie
+	DirectTrustTrie *trie.Trie
+	CompTrustTrie   *trie.Trie
+	Id2DT           map[string]map[string]float64
+	c               float64
+	AddressList     *[]string
+	// nonces is the last nonce of each data record signer, and trustTimes
+	// the timestamp of the last submission for each direct trust pair.
+	nonces     map[string]uint64
+	trustTimes map[string]uint64
+}
+
+// TrustParams tune the composite trust calculation. Every node of a network
+// must use the same ones, since composite trust is part of the state.
+type TrustParams struct {
+	// C is the number of recommenders at which the confidence in the
+	// indirect trust of a pair reaches one half.
+	C float64
+}
+
+var DefaultTrustParams = TrustParams{C: 1}
+
+func DirectTrustKey(addressI, addressJ string) []byte {
+	return []byte(addressI + addressJ)
+}
+
+func CompTrustKey(addressI, addressJ string) []byte {
+	return []byte(addressI + "&" + addressJ)
+}
+
+// openState opens the state committed by a block header.
+func openState(trieDb *trie.Database, header *BlockHeader, meta *stateMeta, params TrustParams) (*State, error) {
+	pkiTrie, err := trie.New(header.PkiRootHash, trieDb)
+	if err != nil {
+		return nil, err
+	}
+	directTrustTrie, err := trie.New(header.DirectTrustRootHash, trieDb)
+	if err != nil {
+		return nil, err
+	}
+	compTrustTrie, err := trie.New(header.CompTrustRootHash, trieDb)
+	if err != nil {
+		return nil, err
+	}
+
+	meta = meta.copy()
+	return &State{
+		PkiTrie:         pkiTrie,
+		DirectTrustTrie: directTrustTrie,
+		CompTrustTrie:   compTrustTrie,
+		Id2DT:           meta.Id2DT,
+		c:               params.C,
+		AddressList:     &meta.AddressList,
+		nonces:          meta.Nonces,
+		trustTimes:      meta.TrustTimes,
+	}, nil
+}
+
+// ReadTries returns copies of the three tries for readers. Lookups cache
+// resolved nodes in the trie they are made on, so readers that only hold a
+// read lock must not use the tries of s directly. The copies share nodes with
+// s, which no trie operation modifies in place.
+func (s *State) ReadTries() (pkiTrie, directTrustTrie, compTrustTrie *trie.Trie) {
+	pki, direct, comp := *s.PkiTrie, *s.DirectTrustTrie, *s.CompTrustTrie
+	return &pki, &direct, &comp
+}
+
+func (s *State) meta() *stateMeta {
+	return &stateMeta{Id2DT: s.Id2DT, AddressList: *s.AddressList, Nonces: s.nonces, TrustTimes: s.trustTimes}
+}
+
+// commit flushes the three tries to disk and returns their roots.
+func (s *State) commit(trieDb *trie.Database) ([3]common.Hash, error) {
+	var roots [3]common.Hash
+	for i, t := range []*trie.Trie{s.PkiTrie, s.DirectTrustTrie, s.CompTrustTrie} {
+		root, _, err := t.Commit(nil)
+		if err != nil {
+			return roots, err
+		}
+		if err := trieDb.Commit(root, false, nil); err != nil {
+			return roots, err
+		}
+		roots[i] = root
+	}
+	return roots, nil
+}
+
+func (s *State) checkRoots(header *BlockHeader) error {
+	if s.PkiTrie.Hash() != header.PkiRootHash {
+		return errors.New("PKI root mismatch")
+	}
+	if s.DirectTrustTrie.Hash() != header.DirectTrustRootHash {
+		return errors.New("direct trust root mismatch")
+	}
+	if s.CompTrustTrie.Hash() != header.CompTrustRootHash {
+		return errors.New("composite trust root mismatch")
+	}
+	return nil
+}
+
+// ApplyRecord verifies a record's signatures and applies the state
+// transition it describes.
+func (s *State) ApplyRecord(r *record.Record) error {
+	if err := r.Verify(); err != nil {
+		return err
+	}
+	return s.apply(r)
+}
+
+// apply applies the state transition of a record whose signatures were
+// verified. Data records must carry increasing nonces per signer, and trust
+// submissions later timestamps per pair, so that a signed record cannot be
+// replayed.
+func (s *State) apply(r *record.Record) error {
+	switch r.Kind {
+	case record.KindData:
+		signer := hex.EncodeToString(r.Signer)
+		if r.Nonce <= s.nonces[signer] {
+			return fmt.Errorf("nonce %d of %s already used", r.Nonce, signer)
+		}
+		s.nonces[signer] = r.Nonce
+		return nil
+	case record.KindPKIRegister:
+		p, _ := r.PKIRegister()
+		if current, _ := s.PkiTrie.TryGet([]byte(p.Address)); current != nil {
+			return errors.New("address " + p.Address + " registered twice")
+		}
+		return s.PkiTrie.TryUpdate([]byte(p.Address), r.Signer)
+	case record.KindPKIUpdate:
+		p, _ := r.PKIUpdate()
+		if current, _ := s.PkiTrie.TryGet([]byte(p.Address)); !bytes.Equal(current, r.Signer) {
+			return errors.New("wrong old public key for address " + p.Address)
+		}
+		newPublicKey, _ := hex.DecodeString(p.NewPublicKey)
+		return s.PkiTrie.TryUpdate([]byte(p.Address), newPublicKey)
+	case record.KindPKIRevoke:
+		p, _ := r.PKIRevoke()
+		if current, _ := s.PkiTrie.TryGet([]byte(p.Address)); !bytes.Equal(current, r.Signer) {
+			return errors.New("wrong public key revoked for address " + p.Address)
+		}
+		return s.PkiTrie.TryDelete([]byte(p.Address))
+	case record.KindTrustSubmit:
+		p, _ := r.TrustSubmit()
+		value, err := strconv.ParseFloat(p.TrustValue, 64)
+		if err != nil || value > 1 || value < -1 {
+			return errors.New("invalid trust value " + p.TrustValue)
+		}
+		if current, _ := s.PkiTrie.TryGet([]byte(p.AddressI)); current == nil {
+			return errors.New("address " + p.AddressI + " is not registered")
+		}
+		key := string(DirectTrustKey(p.AddressI, p.AddressJ))
+		if r.Timestamp <= s.trustTimes[key] {
+			return errors.New("trust submission from " + p.AddressI + " to " + p.AddressJ + " not newer than the last")
+		}
+		s.trustTimes[key] = r.Timestamp
+		s.applyDirectTrust(p.AddressI, p.AddressJ, value)
+		return nil
+	}
+	return fmt.Errorf("unknown record kind %v", r.Kind)
+}
+
+func (s *State) applyDirectTrust(addressI, addressJ string, value float64) {
+	s.DirectTrustTrie.Update(DirectTrustKey(addressI, addressJ), []byte(strconv.FormatFloat(value, 'f', -1, 64)))
+	s.setDirectTrust(addressI, addressJ, value)
+}
+
+// setDirectTrust updates the direct trust matrix and address list, but not
+// the tries.
+func (s *State) setDirectTrust(addressI, addressJ string, value float64) {
+	if s.Id2DT[addressI] == nil {
+		s.Id2DT[addressI] = make(map[string]float64)
+	}
+	s.Id2DT[addressI][addressJ] = value
+
+	if !contains(*s.AddressList, addressI) {
+		*s.AddressList = append(*s.AddressList, addressI)
+	}
+	if !contains(*s.AddressList, addressJ) {
+		*s.AddressList = append(*s.AddressList, addressJ)
+	}
+}
+
+// replay brings the direct trust matrix and the sequences of the state of a
+// block's parent up to the block, whose tries the state already has. The
+// block's records were checked when it was executed.
+func (s *State) replay(block *Block) error {
+	for _, r := range block.Records {
+		switch r.Kind {
+		case record.KindData:
+			s.nonces[hex.EncodeToString(r.Signer)] = r.Nonce
+		case record.KindTrustSubmit:
+			p, err := r.TrustSubmit()
+			if err != nil {
+				return err
+			}
+			value, err := strconv.ParseFloat(p.TrustValue, 64)
+			if err != nil {
+				return err
+			}
+			s.trustTimes[string(DirectTrustKey(p.AddressI, p.AddressJ))] = r.Timestamp
+			s.setDirectTrust(p.AddressI, p.AddressJ, value)
+		}
+	}
+	return nil
+}
+
+// applyBlock applies every record of a block, recomputes composite trust and
+// checks the result against the roots in the block's header.
+func (s *State) applyBlock(block *Block) error {
+	for _, r := range block.Records {
+		if err := s.ApplyRecord(r); err != nil {
+			return err
+		}
+	}
+	s.CalculateAllCompTrust()
+	return s.checkRoots(block.Header())
+}
+
+func (s *State) CompTrust(addressI string, addressJ string) float64 {
+	DT, ok := s.Id2DT[addressI][addressJ]
+	if !ok {
+		return 0
+	}
+
+	iT := 0.0
+	m := 0
+	DtSum := 0.0
+
+	for k, DtIk := range s.Id2DT[addressI] {
+		if k != addressJ && DtIk > 0 {
+			m++
+			DtSum += DtIk
+			DtKj, ok := s.Id2DT[k][addressJ]
+			if ok {
+				iT += DtIk * DtKj
+			}
+		}
+	}
+	if m > 0 {
+		iT /= DtSum
+	}
+
+	alpha := 0.0
+	mu := 0.0
+	sigma := 0.0
+
+	for k, DtIk := range s.Id2DT[addressI] {
+		if k != addressJ && DtIk > 0 {
+			m++
+			DtKj, ok := s.Id2DT[k][addressJ]
+			if !ok {
+				DtKj = 0
+			}
+			sigma += (DtKj - iT) * (DtKj - iT)
+		}
+	}
+
+	mu = float64(m) / (float64(m) + s.c)
+	if m > 0 {
+		sigma = math.Sqrt(sigma / float64(m))
+		sigma = 1 / (1 + sigma)
+	}
+
+	alpha = (mu + sigma) / 4
+
+	result := (1-alpha)*DT + alpha*iT
+
+	return result
+}
+
+func (s *State) CalculateAllCompTrust() {
+	for _, i := range *s.AddressList {
+		for _, j := range *s.AddressList {
+			if i != j {
+				compTrust := s.CompTrust(i, j)
+				err := s.CompTrustTrie.TryUpdate(CompTrustKey(i, j), []byte(strconv.FormatFloat(compTrust, 'f', 6, 64)))
+				if err != nil {
+					log.Fatalf("Error updating CompTrustTrie: %v", err)
+				}
+			}
+		}
+	}
+}
+
+func contains(slice []string, value string) bool {
+	for _, item := range slice {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
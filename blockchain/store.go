@@ -0,0 +1,148 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/ethdb/leveldb"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+)
+
+var (
+	blockPrefix  = []byte("b")
+	statePrefix  = []byte("s")
+	lastBlockKey = []byte("LastBlock")
+)
+
+var errNotFound = errors.New("not found")
+
+// stateMetaInterval is how many blocks apart the state meta is stored.
+const stateMetaInterval = 64
+
+// stateMeta holds the part of a block's state that is not kept in tries.
+// The trie roots are taken from the block header. It is only stored for
+// every stateMetaInterval-th block, starting with genesis.
+type stateMeta struct {
+	Id2DT       map[string]map[string]float64 `json:"id2DT"`
+	AddressList []string                      `json:"addressList"`
+	Nonces      map[string]uint64             `json:"nonces"`
+	TrustTimes  map[string]uint64             `json:"trustTimes"`
+}
+
+func (meta *stateMeta) copy() *stateMeta {
+	id2DT := make(map[string]map[string]float64)
+	for i, row := range meta.Id2DT {
+		id2DT[i] = make(map[string]float64)
+		for j, value := range row {
+			id2DT[i][j] = value
+		}
+	}
+	return &stateMeta{
+		Id2DT:       id2DT,
+		AddressList: append([]string{}, meta.AddressList...),
+		Nonces:      copySequences(meta.Nonces),
+		TrustTimes:  copySequences(meta.TrustTimes),
+	}
+}
+
+func copySequences(sequences map[string]uint64) map[string]uint64 {
+	c := make(map[string]uint64, len(sequences))
+	for key, seq := range sequences {
+		c[key] = seq
+	}
+	return c
+}
+
+func OpenDatabase(dataDir string) (ethdb.KeyValueStore, error) {
+	if dataDir == "" {
+		return memorydb.New(), nil
+	}
+	return leveldb.New(dataDir, 16, 16, "", false)
+}
+
+func blockKey(hash []byte) []byte {
+	return append(append([]byte{}, blockPrefix...), hash...)
+}
+
+func stateKey(hash []byte) []byte {
+	return append(append([]byte{}, statePrefix...), hash...)
+}
+
+func writeBlock(db ethdb.KeyValueWriter, block *Block) error {
+	data, err := json.Marshal(block)
+	if err != nil {
+		return err
+	}
+	return db.Put(blockKey(block.Hash), data)
+}
+
+func readBlock(db ethdb.KeyValueReader, hash []byte) (*Block, error) {
+	data, err := db.Get(blockKey(hash))
+	if err != nil || len(data) == 0 {
+		return nil, errNotFound
+	}
+	block := new(Block)
+	if err := json.Unmarshal(data, block); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+func writeLastBlockHash(db ethdb.KeyValueWriter, hash []byte) error {
+	return db.Put(lastBlockKey, hash)
+}
+
+func readLastBlockHash(db ethdb.KeyValueReader) []byte {
+	if has, _ := db.Has(lastBlockKey); !has {
+		return nil
+	}
+	hash, _ := db.Get(lastBlockKey)
+	return hash
+}
+
+func storesStateMeta(height int) bool {
+	return height%stateMetaInterval == 0
+}
+
+func writeStateMeta(db ethdb.KeyValueWriter, hash []byte, meta *stateMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return db.Put(stateKey(hash), data)
+}
+
+func readStateMeta(db ethdb.KeyValueReader, hash []byte) (*stateMeta, error) {
+	if has, _ := db.Has(stateKey(hash)); !has {
+		return nil, errNotFound
+	}
+	data, err := db.Get(stateKey(hash))
+	if err != nil {
+		return nil, err
+	}
+	meta := new(stateMeta)
+	if err := json.Unmarshal(data, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// readAllBlocks returns every stored block, canonical or not, keyed by hex
+// hash.
+func readAllBlocks(db ethdb.KeyValueStore) (map[string]*Block, error) {
+	blocks := make(map[string]*Block)
+	it := db.NewIterator(blockPrefix, nil)
+	defer it.Release()
+	for it.Next() {
+		if len(it.Key()) != len(blockPrefix)+32 {
+			continue
+		}
+		block := new(Block)
+		if err := json.Unmarshal(it.Value(), block); err != nil {
+			return nil, err
+		}
+		blocks[hex.EncodeToString(block.Hash)] = block
+	}
+	return blocks, it.Error()
+}
@@ -0,0 +1,368 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"github.com/duanjr/trustchain/blockchain"
+	"github.com/duanjr/trustchain/consensus"
+	"github.com/duanjr/trustchain/mempool"
+	"github.com/duanjr/trustchain/p2p"
+	"github.com/duanjr/trustchain/server"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Config is everything a node is started with, as read from a config file.
+// Keys in the file are named like the command line flags, grouped in
+// sections.
+type Config struct {
+	ChainID string `yaml:"chain-id" toml:"chain-id"`
+	// Genesis is the path of the genesis file of the network, if any.
+	Genesis   string          `yaml:"genesis" toml:"genesis"`
+	DataDir   string          `yaml:"data-dir" toml:"data-dir"`
+	Log       LogConfig       `yaml:"log" toml:"log"`
+	Listen    ListenConfig    `yaml:"listen" toml:"listen"`
+	Consensus ConsensusConfig `yaml:"consensus" toml:"consensus"`
+	Block     BlockConfig     `yaml:"block" toml:"block"`
+	Mempool   MempoolConfig   `yaml:"mempool" toml:"mempool"`
+	Trust     TrustConfig     `yaml:"trust" toml:"trust"`
+	P2P       P2PConfig       `yaml:"p2p" toml:"p2p"`
+
+	format  string
+	genesis *blockchain.Genesis
+}
+
+type LogConfig struct {
+	// File is appended to instead of writing to standard error.
+	File         string `yaml:"file" toml:"file"`
+	Microseconds bool   `yaml:"microseconds" toml:"microseconds"`
+}
+
+type ListenConfig struct {
+	Client    string `yaml:"client" toml:"client"`
+	Peer      string `yaml:"peer" toml:"peer"`
+	TLS       bool   `yaml:"tls" toml:"tls"`
+	Cert      string `yaml:"cert" toml:"cert"`
+	Key       string `yaml:"key" toml:"key"`
+	ClientCA  string `yaml:"client-ca" toml:"client-ca"`
+	ClientPKI bool   `yaml:"client-pki" toml:"client-pki"`
+}
+
+type ConsensusConfig struct {
+	Engine     string   `yaml:"engine" toml:"engine"`
+	Validators []string `yaml:"validators" toml:"validators"`
+	// Key is the hex private key this node signs poa and bft blocks with.
+	Key string    `yaml:"key" toml:"key"`
+	PoW PoWConfig `yaml:"pow" toml:"pow"`
+	PoA PoAConfig `yaml:"poa" toml:"poa"`
+	BFT BFTConfig `yaml:"bft" toml:"bft"`
+}
+
+type PoWConfig struct {
+	MinTargetBits       int      `yaml:"min-target-bits" toml:"min-target-bits" json:"minTargetBits"`
+	MaxTargetBits       int      `yaml:"max-target-bits" toml:"max-target-bits" json:"maxTargetBits"`
+	RetargetInterval    int      `yaml:"retarget-interval" toml:"retarget-interval" json:"retargetInterval"`
+	TargetBlockInterval Duration `yaml:"target-block-interval" toml:"target-block-interval" json:"targetBlockInterval"`
+}
+
+type PoAConfig struct {
+	BackupDelay Duration `yaml:"backup-delay" toml:"backup-delay" json:"backupDelay"`
+}
+
+type BFTConfig struct {
+	ProposeTimeout   Duration `yaml:"propose-timeout" toml:"propose-timeout"`
+	PrevoteTimeout   Duration `yaml:"prevote-timeout" toml:"prevote-timeout"`
+	PrecommitTimeout Duration `yaml:"precommit-timeout" toml:"precommit-timeout"`
+	TimeoutDelta     Duration `yaml:"timeout-delta" toml:"timeout-delta"`
+}
+
+type BlockConfig struct {
+	Interval    Duration `yaml:"interval" toml:"interval"`
+	MaxRecords  int      `yaml:"max-records" toml:"max-records"`
+	MaxBytes    int      `yaml:"max-bytes" toml:"max-bytes"`
+	EmptyBlocks bool     `yaml:"empty-blocks" toml:"empty-blocks"`
+}
+
+type MempoolConfig struct {
+	Capacity  int `yaml:"capacity" toml:"capacity"`
+	PerSender int `yaml:"per-sender" toml:"per-sender"`
+}
+
+type TrustConfig struct {
+	C float64 `yaml:"c" toml:"c" json:"c"`
+}
+
+type P2PConfig struct {
+	// NodeKey is the hex private key this node signs its messages to peers
+	// with, instead of the one kept in its database.
+	NodeKey      string   `yaml:"node-key" toml:"node-key"`
+	Permissioned bool     `yaml:"permissioned" toml:"permissioned"`
+	Advertise    string   `yaml:"advertise" toml:"advertise"`
+	Bootstrap    []string `yaml:"bootstrap" toml:"bootstrap"`
+	MaxPeers     int      `yaml:"max-peers" toml:"max-peers"`
+	PingInterval Duration `yaml:"ping-interval" toml:"ping-interval"`
+	TLS          bool     `yaml:"tls" toml:"tls"`
+}
+
+// Duration is a time.Duration written like "1m30s" in config files.
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	duration, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// Default returns the configuration used for everything neither the config
+// file nor the command line sets.
+func Default() *Config {
+	pow, bft := consensus.DefaultPoWParams, consensus.DefaultBFTTimeouts
+	return &Config{
+		ChainID: p2p.DefaultConfig.ChainID,
+		DataDir: "chaindata",
+		Listen: ListenConfig{
+			Client: server.DefaultListenConfig.ClientAddress,
+			Peer:   server.DefaultListenConfig.PeerAddress,
+		},
+		Consensus: ConsensusConfig{
+			Engine: consensus.KindPoW,
+			PoW: PoWConfig{
+				MinTargetBits:       pow.MinTargetBits,
+				MaxTargetBits:       pow.MaxTargetBits,
+				RetargetInterval:    pow.RetargetInterval,
+				TargetBlockInterval: Duration(pow.TargetBlockInterval),
+			},
+			PoA: PoAConfig{BackupDelay: Duration(consensus.DefaultPoAParams.BackupDelay)},
+			BFT: BFTConfig{
+				ProposeTimeout:   Duration(bft.Propose),
+				PrevoteTimeout:   Duration(bft.Prevote),
+				PrecommitTimeout: Duration(bft.Precommit),
+				TimeoutDelta:     Duration(bft.Delta),
+			},
+		},
+		Block: BlockConfig{
+			Interval:   Duration(10 * time.Second),
+			MaxRecords: 1000,
+			MaxBytes:   1 << 20,
+		},
+		Mempool: MempoolConfig{
+			Capacity:  mempool.DefaultConfig.Capacity,
+			PerSender: mempool.DefaultConfig.MaxPerSender,
+		},
+		Trust: TrustConfig{C: blockchain.DefaultTrustParams.C},
+		P2P: P2PConfig{
+			MaxPeers:     p2p.DefaultConfig.MaxPeers,
+			PingInterval: Duration(p2p.DefaultConfig.PingInterval),
+		},
+	}
+}
+
+// Validate checks that the configuration can start a node.
+func (c *Config) Validate() error {
+	switch {
+	case c.ChainID == "":
+		return errors.New("chain-id is empty")
+	case c.DataDir == "":
+		return errors.New("data-dir is empty")
+	}
+
+	if err := validateAddress("listen", c.Listen.Client); err != nil {
+		return err
+	}
+	if err := validateAddress("p2p-listen", c.Listen.Peer); err != nil {
+		return err
+	}
+	if c.Listen.Client == c.Listen.Peer {
+		return errors.New("listen and p2p-listen are the same address")
+	}
+	if (c.Listen.Cert == "") != (c.Listen.Key == "") {
+		return errors.New("tls-cert and tls-key must be given together")
+	}
+	if !c.Listen.TLS && (c.Listen.Cert != "" || c.Listen.ClientCA != "" || c.Listen.ClientPKI) {
+		return errors.New("tls-cert, tls-client-ca and tls-client-pki require tls")
+	}
+
+	cons := c.Consensus
+	switch cons.Engine {
+	case consensus.KindPoW:
+	case consensus.KindPoA, consensus.KindBFT:
+		if len(cons.Validators) == 0 {
+			return fmt.Errorf("%s consensus needs validators", cons.Engine)
+		}
+	default:
+		return fmt.Errorf("unknown consensus engine %q", cons.Engine)
+	}
+	for _, v := range cons.Validators {
+		if !common.IsHexAddress(v) {
+			return fmt.Errorf("invalid validator address %q", v)
+		}
+	}
+	if _, err := parseKey(cons.Key); err != nil {
+		return fmt.Errorf("invalid key: %v", err)
+	}
+	pow := cons.PoW
+	if pow.MinTargetBits < 1 || pow.MinTargetBits > pow.MaxTargetBits || pow.MaxTargetBits > 255 {
+		return errors.New("pow target bits must satisfy 1 <= min <= max <= 255")
+	}
+	if pow.RetargetInterval < 2 {
+		return errors.New("pow retarget-interval must be at least 2 blocks")
+	}
+	if time.Duration(pow.TargetBlockInterval) < time.Second {
+		return errors.New("pow target-block-interval must be at least 1s")
+	}
+	if g := c.genesis; g != nil && cons.Engine == consensus.KindPoW && (g.TargetBits < pow.MinTargetBits || g.TargetBits > pow.MaxTargetBits) {
+		return errors.New("genesis target bits outside the pow target bits")
+	}
+	if time.Duration(cons.PoA.BackupDelay) < time.Second {
+		return errors.New("poa backup-delay must be at least 1s")
+	}
+	bft := cons.BFT
+	if bft.ProposeTimeout <= 0 || bft.PrevoteTimeout <= 0 || bft.PrecommitTimeout <= 0 || bft.TimeoutDelta < 0 {
+		return errors.New("bft timeouts must be positive")
+	}
+
+	switch {
+	case c.Block.Interval <= 0:
+		return errors.New("block-interval must be positive")
+	case c.Block.MaxRecords <= 0 || c.Block.MaxBytes <= 0:
+		return errors.New("block-max-records and block-max-bytes must be positive")
+	case c.Mempool.Capacity <= 0 || c.Mempool.PerSender <= 0:
+		return errors.New("mempool-capacity and mempool-per-sender must be positive")
+	case c.Trust.C <= 0:
+		return errors.New("trust-c must be positive")
+	}
+
+	if _, err := parseKey(c.P2P.NodeKey); err != nil {
+		return fmt.Errorf("invalid node-key: %v", err)
+	}
+	if c.P2P.Advertise != "" {
+		if err := validateAddress("advertise", c.P2P.Advertise); err != nil {
+			return err
+		}
+	}
+	for _, peer := range c.P2P.Bootstrap {
+		if err := validateAddress("bootstrap peer", peer); err != nil {
+			return err
+		}
+	}
+	switch {
+	case c.P2P.MaxPeers <= 0:
+		return errors.New("max-peers must be positive")
+	case c.P2P.PingInterval <= 0:
+		return errors.New("ping-interval must be positive")
+	}
+	return nil
+}
+
+func validateAddress(name, address string) error {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return fmt.Errorf("invalid %s address %q: %v", name, address, err)
+	}
+	return nil
+}
+
+// parseKey parses a hex private key, returning nil for "".
+func parseKey(key string) (*ecdsa.PrivateKey, error) {
+	if key == "" {
+		return nil, nil
+	}
+	return crypto.HexToECDSA(strings.TrimPrefix(key, "0x"))
+}
+
+// Server returns the configuration of the node's server. c must be valid.
+func (c *Config) Server() (server.Config, error) {
+	key, err := parseKey(c.Consensus.Key)
+	if err != nil {
+		return server.Config{}, err
+	}
+	nodeKey, err := parseKey(c.P2P.NodeKey)
+	if err != nil {
+		return server.Config{}, err
+	}
+
+	cons := c.Consensus
+	return server.Config{
+		DataDir: c.DataDir,
+		Genesis: c.genesis,
+		Consensus: consensus.Config{
+			Kind:       cons.Engine,
+			Validators: cons.Validators,
+			Key:        key,
+			PoW: consensus.PoWParams{
+				MinTargetBits:       cons.PoW.MinTargetBits,
+				MaxTargetBits:       cons.PoW.MaxTargetBits,
+				RetargetInterval:    cons.PoW.RetargetInterval,
+				TargetBlockInterval: time.Duration(cons.PoW.TargetBlockInterval),
+			},
+			PoA: consensus.PoAParams{BackupDelay: time.Duration(cons.PoA.BackupDelay)},
+			BFT: consensus.BFTTimeouts{
+				Propose:   time.Duration(cons.BFT.ProposeTimeout),
+				Prevote:   time.Duration(cons.BFT.PrevoteTimeout),
+				Precommit: time.Duration(cons.BFT.PrecommitTimeout),
+				Delta:     time.Duration(cons.BFT.TimeoutDelta),
+			},
+		},
+		Producer: blockchain.ProducerConfig{
+			Interval:    time.Duration(c.Block.Interval),
+			MaxRecords:  c.Block.MaxRecords,
+			MaxBytes:    c.Block.MaxBytes,
+			EmptyBlocks: c.Block.EmptyBlocks,
+		},
+		Trust: blockchain.TrustParams{C: c.Trust.C},
+		Mempool: mempool.Config{
+			Capacity:     c.Mempool.Capacity,
+			MaxPerSender: c.Mempool.PerSender,
+			Priority:     mempool.KindPriority,
+		},
+		Peers: p2p.Config{
+			ChainID:      c.ChainID,
+			NodeKey:      nodeKey,
+			Permissioned: c.P2P.Permissioned,
+			Address:      c.P2P.Advertise,
+			Bootstrap:    c.P2P.Bootstrap,
+			MaxPeers:     c.P2P.MaxPeers,
+			PingInterval: time.Duration(c.P2P.PingInterval),
+			TLS:          c.P2P.TLS,
+		},
+		Listen: server.ListenConfig{
+			ClientAddress: c.Listen.Client,
+			PeerAddress:   c.Listen.Peer,
+			TLS:           c.Listen.TLS,
+			CertFile:      c.Listen.Cert,
+			KeyFile:       c.Listen.Key,
+			ClientCAFile:  c.Listen.ClientCA,
+			ClientPKI:     c.Listen.ClientPKI,
+		},
+	}, nil
+}
+
+// SetupLog directs the standard logger as configured.
+func (c *Config) SetupLog() error {
+	flags := log.LstdFlags
+	if c.Log.Microseconds {
+		flags |= log.Lmicroseconds
+	}
+	log.SetFlags(flags)
+	if c.Log.File == "" {
+		return nil
+	}
+	f, err := os.OpenFile(c.Log.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	log.SetOutput(f)
+	return nil
+}
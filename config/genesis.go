@@ -0,0 +1,80 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/duanjr/trustchain/blockchain"
+	"os"
+)
+
+// Genesis is a genesis file, which every node of a network starts from. It
+// fixes the genesis block and state along with the parameters the nodes
+// must agree on. Parameters it leaves out take their default values, not the
+// ones configured.
+type Genesis struct {
+	ChainID string `json:"chainId"`
+	blockchain.Genesis
+	Consensus   GenesisConsensus `json:"consensus"`
+	TrustParams TrustConfig      `json:"trustParams"`
+}
+
+type GenesisConsensus struct {
+	Engine     string    `json:"engine"`
+	Validators []string  `json:"validators"`
+	PoW        PoWConfig `json:"pow"`
+	PoA        PoAConfig `json:"poa"`
+}
+
+// loadGenesis reads the genesis file over the parameters it fixes.
+func (c *Config) loadGenesis() error {
+	data, err := os.ReadFile(c.Genesis)
+	if err != nil {
+		return err
+	}
+	d := Default()
+	spec := Genesis{
+		ChainID: d.ChainID,
+		Genesis: *blockchain.DefaultGenesis(),
+		Consensus: GenesisConsensus{
+			Engine: d.Consensus.Engine,
+			PoW:    d.Consensus.PoW,
+			PoA:    d.Consensus.PoA,
+		},
+		TrustParams: d.Trust,
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&spec); err != nil {
+		return fmt.Errorf("%s: %v", c.Genesis, err)
+	}
+	if err := spec.Genesis.Validate(); err != nil {
+		return fmt.Errorf("%s: %v", c.Genesis, err)
+	}
+	if spec.Params, err = spec.params(); err != nil {
+		return err
+	}
+
+	c.ChainID = spec.ChainID
+	c.Consensus.Engine = spec.Consensus.Engine
+	c.Consensus.Validators = spec.Consensus.Validators
+	c.Consensus.PoW = spec.Consensus.PoW
+	c.Consensus.PoA = spec.Consensus.PoA
+	c.Trust = spec.TrustParams
+	c.genesis = &spec.Genesis
+	return nil
+}
+
+// params returns the canonical encoding of the parameters spec fixes beside
+// the genesis state.
+func (spec *Genesis) params() ([]byte, error) {
+	consensus := spec.Consensus
+	if len(consensus.Validators) == 0 {
+		consensus.Validators = nil
+	}
+	return json.Marshal(struct {
+		ChainID     string           `json:"chainId"`
+		Consensus   GenesisConsensus `json:"consensus"`
+		TrustParams TrustConfig      `json:"trustParams"`
+	}{spec.ChainID, consensus, spec.TrustParams})
+}
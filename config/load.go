@@ -0,0 +1,194 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/naoina/toml"
+	"gopkg.in/yaml.v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// EnvPrefix starts the environment variables that override the config file.
+// Each is named after a flag: TRUSTCHAIN_MAX_PEERS sets -max-peers.
+const EnvPrefix = "TRUSTCHAIN_"
+
+const (
+	formatYAML = "yaml"
+	formatTOML = "toml"
+)
+
+// Parse builds the configuration from, in increasing precedence, the
+// defaults, the config file named by -config, the environment and the
+// command line args, and validates it. It also returns whether
+// -print-config was given.
+func Parse(args []string) (*Config, bool, error) {
+	c := Default()
+	fs := flag.NewFlagSet("trustchain", flag.ContinueOnError)
+	path := fs.String("config", os.Getenv(EnvPrefix+"CONFIG"), "yaml or toml config file")
+	printConfig := fs.Bool("print-config", false, "print the configuration and exit")
+	c.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, false, err
+	}
+
+	// Flags bind the fields of c, so the values given on the command line
+	// are put back after the file and environment are applied.
+	given := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = f.Value.String()
+	})
+	if *path != "" {
+		if err := c.load(*path); err != nil {
+			return nil, false, err
+		}
+	}
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if value, ok := os.LookupEnv(envName(f.Name)); ok && err == nil && f.Name != "config" {
+			if err = fs.Set(f.Name, value); err != nil {
+				err = fmt.Errorf("%s: %v", envName(f.Name), err)
+			}
+		}
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	for name, value := range given {
+		fs.Set(name, value)
+	}
+	if c.Genesis != "" {
+		if err := c.loadGenesis(); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, false, err
+	}
+	return c, *printConfig, nil
+}
+
+func envName(flag string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+// load reads the config file at path over c. The format is TOML for a .toml
+// file and YAML otherwise. Unknown keys are errors.
+func (c *Config) load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	c.format = formatOf(path)
+	if c.format == formatTOML {
+		err = toml.Unmarshal(data, c)
+	} else {
+		err = yaml.UnmarshalStrict(data, c)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+func formatOf(path string) string {
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		return formatTOML
+	}
+	return formatYAML
+}
+
+// Marshal encodes c in the format of the config file it was loaded from, or
+// YAML, with private keys left out.
+func (c *Config) Marshal() ([]byte, error) {
+	redacted := *c
+	if redacted.Consensus.Key != "" {
+		redacted.Consensus.Key = "(redacted)"
+	}
+	if redacted.P2P.NodeKey != "" {
+		redacted.P2P.NodeKey = "(redacted)"
+	}
+	if c.format != formatTOML {
+		return yaml.Marshal(&redacted)
+	}
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(&redacted); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// register binds the flags of fs to the fields of c.
+func (c *Config) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.ChainID, "chain-id", c.ChainID, "identifier of the network, which peers must share")
+	fs.StringVar(&c.Genesis, "genesis", c.Genesis, "json genesis file of the network, whose chain id, consensus and trust parameters replace the configured ones")
+	fs.StringVar(&c.DataDir, "data-dir", c.DataDir, "directory of the chain database")
+	fs.StringVar(&c.Log.File, "log-file", c.Log.File, "file to append the log to instead of standard error")
+	fs.BoolVar(&c.Log.Microseconds, "log-microseconds", c.Log.Microseconds, "log times with microseconds")
+
+	fs.StringVar(&c.Listen.Client, "listen", c.Listen.Client, "address the client api listens on")
+	fs.StringVar(&c.Listen.Peer, "p2p-listen", c.Listen.Peer, "address the peer api listens on")
+	fs.BoolVar(&c.Listen.TLS, "tls", c.Listen.TLS, "serve the client api over tls")
+	fs.StringVar(&c.Listen.Cert, "tls-cert", c.Listen.Cert, "certificate file of the client api, instead of a certificate of the node key")
+	fs.StringVar(&c.Listen.Key, "tls-key", c.Listen.Key, "key file of the client api certificate")
+	fs.StringVar(&c.Listen.ClientCA, "tls-client-ca", c.Listen.ClientCA, "file of the cas client certificates must be signed by")
+	fs.BoolVar(&c.Listen.ClientPKI, "tls-client-pki", c.Listen.ClientPKI, "require client certificates of keys registered in the pki")
+
+	cons := &c.Consensus
+	fs.StringVar(&cons.Engine, "consensus", cons.Engine, "consensus engine: pow, poa or bft")
+	fs.Var((*listValue)(&cons.Validators), "validators", "comma separated validator addresses for poa and bft")
+	fs.StringVar(&cons.Key, "key", cons.Key, "hex private key this node signs poa and bft blocks with")
+	fs.IntVar(&cons.PoW.MinTargetBits, "pow-min-target-bits", cons.PoW.MinTargetBits, "lowest proof-of-work difficulty in bits")
+	fs.IntVar(&cons.PoW.MaxTargetBits, "pow-max-target-bits", cons.PoW.MaxTargetBits, "highest proof-of-work difficulty in bits")
+	fs.IntVar(&cons.PoW.RetargetInterval, "pow-retarget-interval", cons.PoW.RetargetInterval, "number of blocks between proof-of-work difficulty changes")
+	durationVar(fs, &cons.PoW.TargetBlockInterval, "pow-target-block-interval", "time between blocks the proof-of-work difficulty aims at")
+	durationVar(fs, &cons.PoA.BackupDelay, "poa-backup-delay", "time after the last block each further poa validator in turn order may sign the next one")
+	durationVar(fs, &cons.BFT.ProposeTimeout, "bft-propose-timeout", "time a bft round waits for a proposal")
+	durationVar(fs, &cons.BFT.PrevoteTimeout, "bft-prevote-timeout", "time a bft round waits for prevotes")
+	durationVar(fs, &cons.BFT.PrecommitTimeout, "bft-precommit-timeout", "time a bft round waits for precommits")
+	durationVar(fs, &cons.BFT.TimeoutDelta, "bft-timeout-delta", "time every later bft round of a height waits longer")
+
+	durationVar(fs, &c.Block.Interval, "block-interval", "time after the last block pending records are sealed")
+	fs.IntVar(&c.Block.MaxRecords, "block-max-records", c.Block.MaxRecords, "number of pending records that seals a block at once")
+	fs.IntVar(&c.Block.MaxBytes, "block-max-bytes", c.Block.MaxBytes, "size of pending records in bytes that seals a block at once")
+	fs.BoolVar(&c.Block.EmptyBlocks, "empty-blocks", c.Block.EmptyBlocks, "seal blocks every interval even with no pending records")
+	fs.IntVar(&c.Mempool.Capacity, "mempool-capacity", c.Mempool.Capacity, "number of pending records kept before the lowest priority ones are evicted")
+	fs.IntVar(&c.Mempool.PerSender, "mempool-per-sender", c.Mempool.PerSender, "number of pending records accepted from one sender")
+	fs.Float64Var(&c.Trust.C, "trust-c", c.Trust.C, "number of recommenders at which indirect trust counts for half its weight in composite trust")
+
+	fs.StringVar(&c.P2P.NodeKey, "node-key", c.P2P.NodeKey, "hex private key this node signs its messages to peers with, instead of the one kept in its database")
+	fs.BoolVar(&c.P2P.Permissioned, "permissioned", c.P2P.Permissioned, "only accept peers whose node key is registered in the pki")
+	fs.StringVar(&c.P2P.Advertise, "advertise", c.P2P.Advertise, "host:port other nodes reach this node at")
+	fs.Var((*listValue)(&c.P2P.Bootstrap), "bootstrap", "comma separated host:port of peers to connect to at start")
+	fs.IntVar(&c.P2P.MaxPeers, "max-peers", c.P2P.MaxPeers, "number of active peers beyond which no new ones are accepted")
+	durationVar(fs, &c.P2P.PingInterval, "ping-interval", "time between pings of every peer")
+	fs.BoolVar(&c.P2P.TLS, "p2p-tls", c.P2P.TLS, "connect to peers over mutual tls with certificates of their node keys")
+}
+
+func durationVar(fs *flag.FlagSet, d *Duration, name, usage string) {
+	fs.DurationVar((*time.Duration)(d), name, time.Duration(*d), usage)
+}
+
+// listValue is a comma separated flag.
+type listValue []string
+
+func (l *listValue) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *listValue) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
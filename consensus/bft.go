@@ -0,0 +1,600 @@
+package consensus
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/duanjr/trustchain/blockchain"
+	"github.com/duanjr/trustchain/record"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"log"
+	"math/big"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const tickInterval = 500 * time.Millisecond
+
+// maxFutureRounds bounds how far ahead of the current round proposals and
+// votes are kept, so that a validator cannot fill memory with far rounds.
+const maxFutureRounds = 16
+
+// BFTTimeouts are how long each step of a round waits. Every later round of
+// a height waits Delta longer.
+type BFTTimeouts struct {
+	Propose   time.Duration
+	Prevote   time.Duration
+	Precommit time.Duration
+	Delta     time.Duration
+}
+
+var DefaultBFTTimeouts = BFTTimeouts{
+	Propose:   3 * time.Second,
+	Prevote:   time.Second,
+	Precommit: time.Second,
+	Delta:     500 * time.Millisecond,
+}
+
+// Backend is the node a BFT engine runs on: its chain, mempool and peers.
+type Backend interface {
+	blockchain.ChainReader
+	// Head returns the canonical head and its height.
+	Head() (*blockchain.BlockHeader, int)
+	// Pending returns the number of records waiting for a block.
+	Pending() int
+	// Propose seals a block of the pending records on top of the head.
+	Propose() (*blockchain.Block, error)
+	// VerifyBlock checks a proposed block against the state of its parent.
+	VerifyBlock(block *blockchain.Block) error
+	// Commit adds a certified block to the chain.
+	Commit(block *blockchain.Block) error
+	// Broadcast posts msg to path on every peer without waiting for them.
+	Broadcast(path string, msg interface{})
+}
+
+type VoteType uint8
+
+const (
+	Prevote VoteType = iota
+	Precommit
+)
+
+// Vote is a validator's prevote or precommit for a block, or for no block
+// when BlockHash is empty.
+type Vote struct {
+	Type      VoteType `json:"type"`
+	Height    uint64   `json:"height"`
+	Round     uint64   `json:"round"`
+	BlockHash []byte   `json:"blockHash"`
+	Validator string   `json:"validator"`
+	Signature []byte   `json:"signature"`
+}
+
+// Proposal is the block the proposer of a round puts to the vote. The block
+// may have been sealed by the proposer of an earlier round.
+type Proposal struct {
+	Height    uint64            `json:"height"`
+	Round     uint64            `json:"round"`
+	Block     *blockchain.Block `json:"block"`
+	Validator string            `json:"validator"`
+	Signature []byte            `json:"signature"`
+}
+
+// CommitCertificate is the quorum of precommits that makes a block final. It
+// is stored RLP encoded in the block header.
+type CommitCertificate struct {
+	Round      uint64
+	Precommits []*Vote
+}
+
+type step int
+
+const (
+	stepPropose step = iota
+	stepPrevote
+	stepPrecommit
+)
+
+// BFT is Tendermint-style consensus for a small, fixed validator set. Each
+// round a proposer puts a block to the vote; a block is committed once more
+// than two thirds of the validators precommit it, and the precommits are kept
+// in the block as its commit certificate. Validators are identified like in
+// proof-of-authority.
+type BFT struct {
+	validators []string
+	key        *ecdsa.PrivateKey
+	timeouts   BFTTimeouts
+	self       string
+	proposing  int32
+
+	mu          sync.Mutex
+	backend     Backend
+	height      int
+	round       int
+	step        step
+	active      bool
+	proposals   map[int]*Proposal
+	votes       map[int]map[VoteType]map[string]*Vote
+	lockedBlock *blockchain.Block
+	validBlock  *blockchain.Block
+}
+
+// NewBFT returns a BFT engine. The node takes part in consensus if the
+// address of key is one of the validators; otherwise it only verifies.
+func NewBFT(validators []string, key *ecdsa.PrivateKey, timeouts BFTTimeouts) (*BFT, error) {
+	if len(validators) == 0 {
+		return nil, errors.New("BFT consensus needs at least one validator")
+	}
+	e := &BFT{validators: validators, key: key, timeouts: timeouts}
+	if key != nil {
+		address := record.SignerAddress(crypto.FromECDSAPub(&key.PublicKey))
+		for _, v := range validators {
+			if strings.EqualFold(v, address) {
+				e.self = v
+			}
+		}
+	}
+	return e, nil
+}
+
+func (e *BFT) Prepare(chain blockchain.ChainReader, header *blockchain.BlockHeader) error {
+	if atomic.LoadInt32(&e.proposing) == 0 {
+		return errors.New("blocks are only sealed in consensus rounds")
+	}
+	header.Proposer = e.self
+	return nil
+}
+
+func (e *BFT) Seal(ctx context.Context, header *blockchain.BlockHeader) error {
+	signature, err := crypto.Sign(header.Hash(), e.key)
+	if err != nil {
+		return err
+	}
+	header.Signature = signature
+	return nil
+}
+
+func (e *BFT) VerifyHeader(chain blockchain.ChainReader, header *blockchain.BlockHeader) error {
+	parent, parentHeight := chain.GetHeader(header.PrevBlockHash)
+	if parent == nil {
+		return blockchain.ErrUnknownParent
+	}
+	if err := e.verifySeal(chain, parent, header); err != nil {
+		return err
+	}
+	if len(header.Certificate) == 0 {
+		return errors.New("missing commit certificate")
+	}
+	cert := new(CommitCertificate)
+	if err := rlp.DecodeBytes(header.Certificate, cert); err != nil {
+		return err
+	}
+
+	hash := header.Hash()
+	seen := make(map[string]bool)
+	for _, v := range cert.Precommits {
+		if v.Type != Precommit || v.Height != uint64(parentHeight+1) || v.Round != cert.Round || !bytes.Equal(v.BlockHash, hash) {
+			return errors.New("invalid precommit in commit certificate")
+		}
+		if seen[v.Validator] {
+			return errors.New("duplicate precommit in commit certificate")
+		}
+		if err := e.verifyVote(chain, parent, v); err != nil {
+			return err
+		}
+		seen[v.Validator] = true
+	}
+	if len(seen) < e.quorum() {
+		return errors.New("commit certificate lacks a quorum")
+	}
+	return nil
+}
+
+func (e *BFT) Proposer(height int) string {
+	return e.proposer(height, 0)
+}
+
+func (e *BFT) Finalized(header *blockchain.BlockHeader) bool {
+	return len(header.Certificate) > 0
+}
+
+func (e *BFT) Work(header *blockchain.BlockHeader) *big.Int {
+	return big.NewInt(1)
+}
+
+// Run drives consensus on backend until the process exits.
+func (e *BFT) Run(backend Backend) {
+	e.mu.Lock()
+	e.backend = backend
+	e.mu.Unlock()
+
+	for range time.Tick(tickInterval) {
+		e.tick()
+	}
+}
+
+// HandleProposal processes a proposal received from a peer.
+func (e *BFT) HandleProposal(p *Proposal) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.backend == nil || p.Height != uint64(e.height) || p.Round > uint64(e.round+maxFutureRounds) {
+		return nil
+	}
+	if err := e.verifyProposal(p); err != nil {
+		return err
+	}
+	e.addProposal(p)
+	return nil
+}
+
+// HandleVote processes a vote received from a peer.
+func (e *BFT) HandleVote(v *Vote) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.backend == nil || v.Height != uint64(e.height) || v.Round > uint64(e.round+maxFutureRounds) {
+		return nil
+	}
+	parent, _ := e.backend.Head()
+	if err := e.verifyVote(e.backend, parent, v); err != nil {
+		return err
+	}
+	e.addVote(v)
+	return nil
+}
+
+// HandleCommit adds a certified block received from a peer, letting a
+// validator that missed the votes catch up.
+func (e *BFT) HandleCommit(block *blockchain.Block) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.backend == nil {
+		return nil
+	}
+	if err := e.backend.Commit(block); err != nil {
+		return err
+	}
+	e.syncHeight()
+	return nil
+}
+
+func (e *BFT) tick() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.syncHeight()
+	if !e.active && e.backend.Pending() > 0 {
+		e.activate()
+	}
+	if e.step == stepPropose && e.proposals[e.round] == nil && e.proposer(e.height, e.round) == e.self {
+		e.propose()
+	}
+}
+
+// syncHeight moves to the height after the head if the chain has advanced.
+func (e *BFT) syncHeight() {
+	if _, head := e.backend.Head(); head >= e.height {
+		e.height = head + 1
+		e.proposals = make(map[int]*Proposal)
+		e.votes = make(map[int]map[VoteType]map[string]*Vote)
+		e.lockedBlock = nil
+		e.validBlock = nil
+		e.active = false
+		e.startRound(0)
+	}
+}
+
+func (e *BFT) startRound(round int) {
+	e.round = round
+	e.step = stepPropose
+	if round > 0 {
+		e.active = false
+		e.activate()
+	}
+	if p := e.proposals[round]; p != nil {
+		e.prevote(p)
+	}
+}
+
+// activate starts the round timer. Rounds stay idle until there is something
+// to agree on, so that no empty blocks are produced.
+func (e *BFT) activate() {
+	if e.active {
+		return
+	}
+	e.active = true
+	e.schedule(stepPropose, e.timeouts.Propose+time.Duration(e.round)*e.timeouts.Delta)
+}
+
+func (e *BFT) schedule(s step, d time.Duration) {
+	height, round := e.height, e.round
+	time.AfterFunc(d, func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+
+		if e.height != height || e.round != round {
+			return
+		}
+		switch s {
+		case stepPropose:
+			if e.step == stepPropose {
+				e.castVote(Prevote, nil)
+			}
+		case stepPrevote:
+			if e.step == stepPrevote {
+				e.castVote(Precommit, nil)
+			}
+		case stepPrecommit:
+			e.startRound(round + 1)
+		}
+	})
+}
+
+func (e *BFT) propose() {
+	block := e.validBlock
+	if block == nil {
+		if e.backend.Pending() == 0 {
+			return
+		}
+		var err error
+		atomic.StoreInt32(&e.proposing, 1)
+		block, err = e.backend.Propose()
+		atomic.StoreInt32(&e.proposing, 0)
+		if err != nil {
+			log.Printf("Error proposing block: %v", err)
+			return
+		}
+	}
+
+	p := &Proposal{Height: uint64(e.height), Round: uint64(e.round), Block: block, Validator: e.self}
+	signature, err := crypto.Sign(p.hash(), e.key)
+	if err != nil {
+		log.Printf("Error signing proposal: %v", err)
+		return
+	}
+	p.Signature = signature
+	e.backend.Broadcast("/consensus/proposal", p)
+	e.addProposal(p)
+}
+
+func (e *BFT) verifyProposal(p *Proposal) error {
+	if p.Block == nil {
+		return errors.New("proposal without block")
+	}
+	if p.Validator != e.proposer(e.height, int(p.Round)) {
+		return fmt.Errorf("round %d is not proposed by %s", p.Round, p.Validator)
+	}
+	parent, _ := e.backend.Head()
+	if !bytes.Equal(p.Block.PrevBlockHash, parent.Hash()) {
+		return errors.New("proposed block does not extend the head")
+	}
+	signer, err := crypto.SigToPub(p.hash(), p.Signature)
+	if err != nil {
+		return errors.New("invalid proposal signature")
+	}
+	if err := authorize(e.backend, parent, p.Validator, crypto.FromECDSAPub(signer)); err != nil {
+		return err
+	}
+	if err := e.verifySeal(e.backend, parent, p.Block.Header()); err != nil {
+		return err
+	}
+	return e.backend.VerifyBlock(p.Block)
+}
+
+func (e *BFT) addProposal(p *Proposal) {
+	round := int(p.Round)
+	if e.proposals[round] != nil {
+		return
+	}
+	e.proposals[round] = p
+	e.activate()
+
+	if round == e.round && e.step == stepPropose {
+		e.prevote(p)
+	}
+	e.checkVotes(round)
+}
+
+// prevote votes for the proposal of the current round unless this node is
+// locked on another block.
+func (e *BFT) prevote(p *Proposal) {
+	if e.lockedBlock == nil || bytes.Equal(e.lockedBlock.Hash, p.Block.Hash) {
+		e.castVote(Prevote, p.Block.Hash)
+	} else {
+		e.castVote(Prevote, nil)
+	}
+}
+
+func (e *BFT) castVote(t VoteType, hash []byte) {
+	if t == Prevote {
+		e.step = stepPrevote
+	} else {
+		e.step = stepPrecommit
+	}
+	if e.self == "" {
+		return
+	}
+
+	v := &Vote{Type: t, Height: uint64(e.height), Round: uint64(e.round), BlockHash: hash, Validator: e.self}
+	signature, err := crypto.Sign(v.hash(), e.key)
+	if err != nil {
+		log.Printf("Error signing vote: %v", err)
+		return
+	}
+	v.Signature = signature
+	e.backend.Broadcast("/consensus/vote", v)
+	e.addVote(v)
+}
+
+func (e *BFT) addVote(v *Vote) {
+	round := int(v.Round)
+	if e.votes[round] == nil {
+		e.votes[round] = map[VoteType]map[string]*Vote{Prevote: {}, Precommit: {}}
+	}
+	votes := e.votes[round][v.Type]
+	if votes[v.Validator] != nil {
+		return
+	}
+	votes[v.Validator] = v
+	e.activate()
+
+	// Skip ahead once enough validators are in a later round that at least
+	// one of them is honest.
+	if round > e.round && e.voters(round) > len(e.validators)-e.quorum() {
+		e.startRound(round)
+	}
+	e.checkVotes(round)
+}
+
+// voters returns the number of distinct validators that voted in round.
+func (e *BFT) voters(round int) int {
+	voters := map[string]bool{}
+	for _, votes := range e.votes[round] {
+		for validator := range votes {
+			voters[validator] = true
+		}
+	}
+	return len(voters)
+}
+
+func (e *BFT) checkVotes(round int) {
+	if hash, ok := e.majority(round, Precommit); ok && hash != nil {
+		if block := e.proposedBlock(hash); block != nil {
+			e.commit(block, round)
+			return
+		}
+	}
+	if round != e.round {
+		return
+	}
+
+	if hash, ok := e.majority(round, Prevote); ok {
+		if hash == nil {
+			if e.step == stepPrevote {
+				e.castVote(Precommit, nil)
+			}
+		} else if block := e.proposedBlock(hash); block != nil {
+			e.validBlock = block
+			if e.step == stepPrevote {
+				e.lockedBlock = block
+				e.castVote(Precommit, hash)
+			}
+		}
+	} else if e.step == stepPrevote && len(e.votes[round][Prevote]) >= e.quorum() {
+		e.schedule(stepPrevote, e.timeouts.Prevote+time.Duration(round)*e.timeouts.Delta)
+	}
+	if e.round == round && len(e.votes[round][Precommit]) >= e.quorum() {
+		e.schedule(stepPrecommit, e.timeouts.Precommit+time.Duration(round)*e.timeouts.Delta)
+	}
+}
+
+// majority returns the block hash more than two thirds of the votes of a
+// type in round are for, if any.
+func (e *BFT) majority(round int, t VoteType) ([]byte, bool) {
+	counts := make(map[string]int)
+	for _, v := range e.votes[round][t] {
+		key := hex.EncodeToString(v.BlockHash)
+		counts[key]++
+		if counts[key] >= e.quorum() {
+			return v.BlockHash, true
+		}
+	}
+	return nil, false
+}
+
+func (e *BFT) proposedBlock(hash []byte) *blockchain.Block {
+	for _, p := range e.proposals {
+		if bytes.Equal(p.Block.Hash, hash) {
+			return p.Block
+		}
+	}
+	return nil
+}
+
+func (e *BFT) commit(block *blockchain.Block, round int) {
+	cert := &CommitCertificate{Round: uint64(round)}
+	for _, v := range e.votes[round][Precommit] {
+		if bytes.Equal(v.BlockHash, block.Hash) {
+			cert.Precommits = append(cert.Precommits, v)
+		}
+	}
+	data, err := rlp.EncodeToBytes(cert)
+	if err != nil {
+		log.Printf("Error encoding commit certificate: %v", err)
+		return
+	}
+
+	committed := *block
+	committed.Certificate = data
+	if err := e.backend.Commit(&committed); err != nil {
+		log.Printf("Error committing block %x: %v", block.Hash, err)
+		return
+	}
+	e.backend.Broadcast("/consensus/commit", &committed)
+	e.syncHeight()
+}
+
+func (e *BFT) verifySeal(chain blockchain.ChainReader, parent, header *blockchain.BlockHeader) error {
+	if !e.isValidator(header.Proposer) {
+		return errors.New(header.Proposer + " is not a validator")
+	}
+	signer, err := crypto.SigToPub(header.Hash(), header.Signature)
+	if err != nil {
+		return errors.New("invalid block signature")
+	}
+	return authorize(chain, parent, header.Proposer, crypto.FromECDSAPub(signer))
+}
+
+func (e *BFT) verifyVote(chain blockchain.ChainReader, parent *blockchain.BlockHeader, v *Vote) error {
+	if !e.isValidator(v.Validator) {
+		return errors.New(v.Validator + " is not a validator")
+	}
+	signer, err := crypto.SigToPub(v.hash(), v.Signature)
+	if err != nil {
+		return errors.New("invalid vote signature")
+	}
+	return authorize(chain, parent, v.Validator, crypto.FromECDSAPub(signer))
+}
+
+func (e *BFT) isValidator(address string) bool {
+	for _, v := range e.validators {
+		if v == address {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *BFT) proposer(height, round int) string {
+	return e.validators[(height+round)%len(e.validators)]
+}
+
+// quorum is the smallest number of validators that is more than two thirds
+// of the set.
+func (e *BFT) quorum() int {
+	return len(e.validators)*2/3 + 1
+}
+
+func (v *Vote) hash() []byte {
+	return crypto.Keccak256(mustEncode([]interface{}{v.Type, v.Height, v.Round, v.BlockHash, v.Validator}))
+}
+
+func (p *Proposal) hash() []byte {
+	return crypto.Keccak256(mustEncode([]interface{}{"proposal", p.Height, p.Round, p.Block.Hash, p.Validator}))
+}
+
+func mustEncode(val interface{}) []byte {
+	data, err := rlp.EncodeToBytes(val)
+	if err != nil {
+		log.Panic(err)
+	}
+	return data
+}
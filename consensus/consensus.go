@@ -0,0 +1,56 @@
+package consensus
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"github.com/duanjr/trustchain/blockchain"
+	"time"
+)
+
+// Engine is declared next to the block types it seals so the blockchain
+// package can drive it without importing this one.
+type Engine = blockchain.Engine
+
+// allowedFutureBlockTime is how far ahead of the local clock a header may be
+// stamped, to allow for clock skew between nodes.
+const allowedFutureBlockTime = 15 * time.Second
+
+const (
+	KindPoW = "pow"
+	KindPoA = "poa"
+	KindBFT = "bft"
+)
+
+// Config selects the engine at node startup. Validators and Key are not
+// used by proof-of-work.
+type Config struct {
+	Kind       string
+	Validators []string
+	Key        *ecdsa.PrivateKey
+	PoW        PoWParams
+	PoA        PoAParams
+	BFT        BFTTimeouts
+}
+
+// New returns the engine cfg selects.
+func New(cfg Config) (Engine, error) {
+	switch cfg.Kind {
+	case KindPoW, "":
+		return NewPoW(cfg.PoW), nil
+	case KindPoA:
+		return NewPoA(cfg.Validators, cfg.Key, cfg.PoA)
+	case KindBFT:
+		return NewBFT(cfg.Validators, cfg.Key, cfg.BFT)
+	}
+	return nil, errors.New("unknown consensus engine " + cfg.Kind)
+}
+
+// verifyTime rejects a header stamped further in the future than clock skew
+// explains.
+func verifyTime(header *blockchain.BlockHeader) error {
+	if ahead := time.Until(time.Unix(header.Timestamp, 0)); ahead > allowedFutureBlockTime {
+		return fmt.Errorf("%w: %v ahead", blockchain.ErrFutureBlock, ahead.Round(time.Second))
+	}
+	return nil
+}
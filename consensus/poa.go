@@ -0,0 +1,177 @@
+package consensus
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"github.com/duanjr/trustchain/blockchain"
+	"github.com/duanjr/trustchain/record"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// ErrNotProposer is returned when this node is asked to seal a block that is
+// another validator's turn.
+var ErrNotProposer = errors.New("not the proposer")
+
+// PoAParams tune proof-of-authority. Every node of a network must use the
+// same ones.
+type PoAParams struct {
+	// BackupDelay is how long after its parent a block may be signed by the
+	// validator after the one in turn, and twice as long by the one after
+	// that, and so on, so that the chain goes on while validators are down.
+	BackupDelay time.Duration
+}
+
+var DefaultPoAParams = PoAParams{BackupDelay: 30 * time.Second}
+
+// PoA is proof-of-authority: the validators, identified by their addresses
+// in the PKI trie, take turns signing blocks in the configured order. A
+// block's Nonce is the distance of its proposer from the validator in turn,
+// which is 0 unless a backup signed it. Blocks signed in turn weigh more, so
+// they replace a backup's block at the same height.
+type PoA struct {
+	validators []string
+	key        *ecdsa.PrivateKey
+	params     PoAParams
+}
+
+// NewPoA returns a proof-of-authority engine. key signs the blocks of this
+// node and may be nil for a node that only verifies.
+func NewPoA(validators []string, key *ecdsa.PrivateKey, params PoAParams) (*PoA, error) {
+	if len(validators) == 0 {
+		return nil, errors.New("proof of authority needs at least one validator")
+	}
+	return &PoA{validators: validators, key: key, params: params}, nil
+}
+
+// Prepare signs the block as the first validator in turn order whose key is
+// this node's, once that validator's backup delay has passed.
+func (e *PoA) Prepare(chain blockchain.ChainReader, header *blockchain.BlockHeader) error {
+	if e.key == nil {
+		return errors.New("no signing key configured")
+	}
+	parent, height, err := e.parent(chain, header)
+	if err != nil {
+		return err
+	}
+
+	publicKey := crypto.FromECDSAPub(&e.key.PublicKey)
+	for distance := range e.validators {
+		proposer := e.validators[(height+distance)%len(e.validators)]
+		if err := authorize(chain, parent, proposer, publicKey); err != nil {
+			continue
+		}
+		if header.Timestamp < e.earliest(parent, distance) {
+			break
+		}
+		header.Proposer = proposer
+		header.Nonce = distance
+		return nil
+	}
+	return fmt.Errorf("%w: block %d is to be signed by %s", ErrNotProposer, height, e.Proposer(height))
+}
+
+// Seal signs the header once its timestamp is reached, so that the block is
+// not ahead of the clocks of the nodes that verify it.
+func (e *PoA) Seal(ctx context.Context, header *blockchain.BlockHeader) error {
+	if wait := time.Until(time.Unix(header.Timestamp, 0)); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	signature, err := crypto.Sign(header.Hash(), e.key)
+	if err != nil {
+		return err
+	}
+	header.Signature = signature
+	return nil
+}
+
+func (e *PoA) VerifyHeader(chain blockchain.ChainReader, header *blockchain.BlockHeader) error {
+	parent, height, err := e.parent(chain, header)
+	if err != nil {
+		return err
+	}
+	distance := header.Nonce
+	if distance < 0 || distance >= len(e.validators) || header.Proposer != e.validators[(height+distance)%len(e.validators)] {
+		return fmt.Errorf("block %d signed out of turn by %s", height, header.Proposer)
+	}
+	if header.Timestamp < e.earliest(parent, distance) {
+		return fmt.Errorf("block %d signed by backup %s before its delay", height, header.Proposer)
+	}
+	if err := verifyTime(header); err != nil {
+		return err
+	}
+
+	signer, err := crypto.SigToPub(header.Hash(), header.Signature)
+	if err != nil {
+		return errors.New("invalid block signature")
+	}
+	return authorize(chain, parent, header.Proposer, crypto.FromECDSAPub(signer))
+}
+
+// Proposer returns the validator in turn at height.
+func (e *PoA) Proposer(height int) string {
+	return e.validators[height%len(e.validators)]
+}
+
+func (e *PoA) Finalized(header *blockchain.BlockHeader) bool {
+	return false
+}
+
+func (e *PoA) Work(header *blockchain.BlockHeader) *big.Int {
+	if header.Nonce == 0 {
+		return big.NewInt(2)
+	}
+	return big.NewInt(1)
+}
+
+// earliest returns the first timestamp at which the validator distance
+// places after the one in turn may sign a block on parent.
+func (e *PoA) earliest(parent *blockchain.BlockHeader, distance int) int64 {
+	return parent.Timestamp + int64(time.Duration(distance)*e.params.BackupDelay/time.Second)
+}
+
+func (e *PoA) parent(chain blockchain.ChainReader, header *blockchain.BlockHeader) (*blockchain.BlockHeader, int, error) {
+	parent, parentHeight := chain.GetHeader(header.PrevBlockHash)
+	if parent == nil {
+		return nil, 0, blockchain.ErrUnknownParent
+	}
+	return parent, parentHeight + 1, nil
+}
+
+// authorize checks that publicKey is the key the PKI trie holds for address
+// at parent. Until the first key is registered, validators are identified by
+// the address of their key instead, so the chain can be bootstrapped. If the
+// state of parent is not known, the error wraps blockchain.ErrMissingState.
+func authorize(chain blockchain.ChainReader, parent *blockchain.BlockHeader, address string, publicKey []byte) error {
+	if parent.PkiRootHash == (common.Hash{}) || parent.PkiRootHash == types.EmptyRootHash {
+		if !strings.EqualFold(record.SignerAddress(publicKey), address) {
+			return errors.New("block not signed by validator " + address)
+		}
+		return nil
+	}
+
+	registered, err := chain.PKIKey(parent, address)
+	if errors.Is(err, blockchain.ErrMissingState) {
+		return err
+	}
+	if err != nil || registered == nil {
+		return errors.New("validator " + address + " is not registered")
+	}
+	if !bytes.Equal(registered, publicKey) {
+		return errors.New("block not signed by validator " + address)
+	}
+	return nil
+}
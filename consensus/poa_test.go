@@ -0,0 +1,101 @@
+package consensus
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"errors"
+	"github.com/duanjr/trustchain/blockchain"
+	"github.com/duanjr/trustchain/record"
+	"github.com/ethereum/go-ethereum/crypto"
+	"testing"
+	"time"
+)
+
+// testChain holds headers before any key is registered, so validators are
+// identified by the addresses of their keys.
+type testChain map[string]*blockchain.BlockHeader
+
+func (c testChain) GetHeader(hash []byte) (*blockchain.BlockHeader, int) {
+	return c[hex.EncodeToString(hash)], 0
+}
+
+func (c testChain) PKIKey(*blockchain.BlockHeader, string) ([]byte, error) {
+	return nil, nil
+}
+
+func TestPoABackupProposer(t *testing.T) {
+	var keys []*ecdsa.PrivateKey
+	var validators []string
+	for i := 0; i < 3; i++ {
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+		validators = append(validators, record.SignerAddress(crypto.FromECDSAPub(&key.PublicKey)))
+	}
+	params := PoAParams{BackupDelay: DefaultPoAParams.BackupDelay}
+	delay := int64(params.BackupDelay.Seconds())
+
+	parent := &blockchain.BlockHeader{Timestamp: 1000}
+	chain := testChain{hex.EncodeToString(parent.Hash()): parent}
+	header := func(timestamp int64) *blockchain.BlockHeader {
+		return &blockchain.BlockHeader{PrevBlockHash: parent.Hash(), Timestamp: timestamp}
+	}
+	seal := func(i int, h *blockchain.BlockHeader) error {
+		e, _ := NewPoA(validators, keys[i], params)
+		if err := e.Prepare(chain, h); err != nil {
+			return err
+		}
+		return e.Seal(context.Background(), h)
+	}
+	verifier, _ := NewPoA(validators, nil, params)
+
+	inTurn := header(parent.Timestamp + 1)
+	if err := seal(1, inTurn); err != nil {
+		t.Fatalf("in-turn validator cannot seal: %v", err)
+	}
+	if err := verifier.VerifyHeader(chain, inTurn); err != nil {
+		t.Fatalf("in-turn block rejected: %v", err)
+	}
+
+	if err := seal(2, header(parent.Timestamp+delay-1)); !errors.Is(err, ErrNotProposer) {
+		t.Fatalf("backup sealed before its delay: %v", err)
+	}
+	backup := header(parent.Timestamp + delay)
+	if err := seal(2, backup); err != nil {
+		t.Fatalf("backup cannot seal after its delay: %v", err)
+	}
+	if err := verifier.VerifyHeader(chain, backup); err != nil {
+		t.Fatalf("backup block rejected: %v", err)
+	}
+	if verifier.Work(inTurn).Cmp(verifier.Work(backup)) <= 0 {
+		t.Error("backup block weighs as much as the in-turn one")
+	}
+
+	early := header(parent.Timestamp + 2*delay - 1)
+	if err := seal(0, early); !errors.Is(err, ErrNotProposer) {
+		t.Fatalf("second backup sealed before its delay: %v", err)
+	}
+	early.Proposer, early.Nonce = validators[0], 2
+	early.Signature, _ = crypto.Sign(early.Hash(), keys[0])
+	if err := verifier.VerifyHeader(chain, early); err == nil {
+		t.Error("block of a backup before its delay accepted")
+	}
+
+	future := header(time.Now().Add(time.Hour).Unix())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	e, _ := NewPoA(validators, keys[1], params)
+	if err := e.Prepare(chain, future); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Seal(ctx, future); err == nil {
+		t.Error("block signed before its timestamp")
+	}
+	future.Signature, _ = crypto.Sign(future.Hash(), keys[1])
+	if err := verifier.VerifyHeader(chain, future); !errors.Is(err, blockchain.ErrFutureBlock) {
+		t.Errorf("block from the future accepted: %v", err)
+	}
+}
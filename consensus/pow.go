@@ -0,0 +1,192 @@
+package consensus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/duanjr/trustchain/blockchain"
+	"math"
+	"math/big"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	maxNonce           = math.MaxInt64
+	abortCheckInterval = 1 << 12
+	// medianTimeBlocks is the number of ancestors whose median timestamp a
+	// block must come after.
+	medianTimeBlocks = 11
+)
+
+// PoWParams tune the difficulty of proof-of-work. Every node of a network
+// must use the same ones.
+type PoWParams struct {
+	MinTargetBits int
+	MaxTargetBits int
+	// RetargetInterval is the number of blocks between difficulty changes.
+	RetargetInterval int
+	// TargetBlockInterval is the time between blocks the difficulty aims at.
+	TargetBlockInterval time.Duration
+}
+
+var DefaultPoWParams = PoWParams{
+	MinTargetBits:       8,
+	MaxTargetBits:       32,
+	RetargetInterval:    10,
+	TargetBlockInterval: 60 * time.Second,
+}
+
+// PoW is SHA-256 proof-of-work with the difficulty retargeted every
+// RetargetInterval blocks.
+type PoW struct {
+	params PoWParams
+}
+
+func NewPoW(params PoWParams) *PoW {
+	return &PoW{params: params}
+}
+
+func (e *PoW) Prepare(chain blockchain.ChainReader, header *blockchain.BlockHeader) error {
+	bits, err := e.nextTargetBits(chain, header)
+	if err != nil {
+		return err
+	}
+	header.TargetBits = bits
+	if past := medianTimePast(chain, header); header.Timestamp <= past {
+		header.Timestamp = past + 1
+	}
+	return nil
+}
+
+// Seal searches the nonce space on every CPU, each worker trying the nonces
+// congruent to its index.
+func (e *PoW) Seal(ctx context.Context, header *blockchain.BlockHeader) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	workers := runtime.NumCPU()
+	target := powTarget(header.TargetBits)
+	found := make(chan int, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(start int) {
+			defer wg.Done()
+
+			h := *header
+			var hashInt big.Int
+			for h.Nonce = start; h.Nonce < maxNonce-workers; h.Nonce += workers {
+				if h.Nonce%abortCheckInterval < workers && ctx.Err() != nil {
+					return
+				}
+				hashInt.SetBytes(h.Hash())
+				if hashInt.Cmp(target) == -1 {
+					found <- h.Nonce
+					return
+				}
+			}
+		}(i)
+	}
+	exhausted := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(exhausted)
+	}()
+
+	select {
+	case nonce := <-found:
+		header.Nonce = nonce
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-exhausted:
+		return errors.New("nonce space exhausted")
+	}
+}
+
+func (e *PoW) VerifyHeader(chain blockchain.ChainReader, header *blockchain.BlockHeader) error {
+	bits, err := e.nextTargetBits(chain, header)
+	if err != nil {
+		return err
+	}
+	if header.TargetBits != bits {
+		return fmt.Errorf("wrong difficulty: got %d target bits, want %d", header.TargetBits, bits)
+	}
+	if past := medianTimePast(chain, header); header.Timestamp <= past {
+		return fmt.Errorf("block timestamp %d not after the median time past %d", header.Timestamp, past)
+	}
+	if err := verifyTime(header); err != nil {
+		return err
+	}
+
+	var hashInt big.Int
+	hashInt.SetBytes(header.Hash())
+	if hashInt.Cmp(powTarget(header.TargetBits)) != -1 {
+		return errors.New("insufficient proof of work")
+	}
+	return nil
+}
+
+func (e *PoW) Proposer(height int) string {
+	return ""
+}
+
+func (e *PoW) Finalized(header *blockchain.BlockHeader) bool {
+	return false
+}
+
+func (e *PoW) Work(header *blockchain.BlockHeader) *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(header.TargetBits))
+}
+
+// medianTimePast returns the median timestamp of the medianTimeBlocks
+// ancestors of header, or of all of them near genesis.
+func medianTimePast(chain blockchain.ChainReader, header *blockchain.BlockHeader) int64 {
+	var timestamps []int64
+	for parent, _ := chain.GetHeader(header.PrevBlockHash); parent != nil && len(timestamps) < medianTimeBlocks; parent, _ = chain.GetHeader(parent.PrevBlockHash) {
+		timestamps = append(timestamps, parent.Timestamp)
+	}
+	if len(timestamps) == 0 {
+		return 0
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	return timestamps[len(timestamps)/2]
+}
+
+func powTarget(bits int) *big.Int {
+	target := big.NewInt(1)
+	return target.Lsh(target, uint(256-bits))
+}
+
+// nextTargetBits returns the difficulty required of header. Every
+// RetargetInterval blocks the difficulty moves one bit toward
+// TargetBlockInterval per block, based on the time the last interval took.
+func (e *PoW) nextTargetBits(chain blockchain.ChainReader, header *blockchain.BlockHeader) (int, error) {
+	parent, parentHeight := chain.GetHeader(header.PrevBlockHash)
+	if parent == nil {
+		return 0, blockchain.ErrUnknownParent
+	}
+	height := parentHeight + 1
+	p := e.params
+	if height%p.RetargetInterval != 0 {
+		return parent.TargetBits, nil
+	}
+
+	first := parent
+	for i := 1; i < p.RetargetInterval; i++ {
+		first, _ = chain.GetHeader(first.PrevBlockHash)
+	}
+	actual := parent.Timestamp - first.Timestamp
+	expected := int64(p.RetargetInterval-1) * int64(p.TargetBlockInterval/time.Second)
+
+	bits := parent.TargetBits
+	if actual < expected/2 && bits < p.MaxTargetBits {
+		bits++
+	} else if actual > expected*2 && bits > p.MinTargetBits {
+		bits--
+	}
+	return bits, nil
+}
@@ -0,0 +1,50 @@
+package consensus
+
+import (
+	"context"
+	"encoding/hex"
+	"github.com/duanjr/trustchain/blockchain"
+	"testing"
+	"time"
+)
+
+func TestPoWTimestamp(t *testing.T) {
+	chain := testChain{}
+	var parent *blockchain.BlockHeader
+	for _, timestamp := range []int64{300, 100, 200} {
+		h := &blockchain.BlockHeader{TargetBits: 1, Timestamp: timestamp}
+		if parent != nil {
+			h.PrevBlockHash = parent.Hash()
+		}
+		chain[hex.EncodeToString(h.Hash())] = h
+		parent = h
+	}
+	e := NewPoW(PoWParams{MinTargetBits: 1, MaxTargetBits: 1, RetargetInterval: 10, TargetBlockInterval: time.Second})
+	seal := func(timestamp int64) *blockchain.BlockHeader {
+		h := &blockchain.BlockHeader{PrevBlockHash: parent.Hash(), Timestamp: timestamp}
+		if err := e.Prepare(chain, h); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.Seal(context.Background(), h); err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	if h := seal(150); h.Timestamp != 201 {
+		t.Errorf("prepared timestamp %d, want one after the median time past", h.Timestamp)
+	}
+	stale := &blockchain.BlockHeader{PrevBlockHash: parent.Hash(), Timestamp: 200, TargetBits: 1}
+	if err := e.Seal(context.Background(), stale); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.VerifyHeader(chain, stale); err == nil {
+		t.Error("block not after the median time past accepted")
+	}
+	if err := e.VerifyHeader(chain, seal(time.Now().Add(time.Hour).Unix())); err == nil {
+		t.Error("block from the future accepted")
+	}
+	if err := e.VerifyHeader(chain, seal(250)); err != nil {
+		t.Errorf("block after the median time past rejected: %v", err)
+	}
+}
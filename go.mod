@@ -2,7 +2,12 @@ module github.com/duanjr/trustchain
 
 go 1.18
 
-require github.com/ethereum/go-ethereum v1.10.16
+require (
+	github.com/ethereum/go-ethereum v1.10.16
+	github.com/gorilla/mux v1.8.0
+	github.com/naoina/toml v0.1.2-0.20170918210437-9fafd6967416
+	gopkg.in/yaml.v2 v2.4.0
+)
 
 require (
 	github.com/StackExchange/wmi v0.0.0-20180116203802-5d049714c4a6 // indirect
@@ -12,8 +17,8 @@ require (
 	github.com/go-ole/go-ole v1.2.1 // indirect
 	github.com/go-stack/stack v1.8.0 // indirect
 	github.com/golang/snappy v0.0.4 // indirect
-	github.com/gorilla/mux v1.8.0 // indirect
 	github.com/mattn/go-runewidth v0.0.9 // indirect
+	github.com/naoina/go-stringutil v0.1.0 // indirect
 	github.com/olekukonko/tablewriter v0.0.5 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/prometheus/tsdb v0.7.1 // indirect
@@ -1,9 +1,37 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"github.com/duanjr/trustchain/config"
 	"github.com/duanjr/trustchain/server"
+	"log"
+	"os"
 )
 
 func main() {
-	server.RunServer()
+	cfg, printConfig, err := config.Parse(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if printConfig {
+		data, err := cfg.Marshal()
+		if err != nil {
+			log.Fatalf("Error encoding configuration: %v", err)
+		}
+		fmt.Print(string(data))
+		return
+	}
+	if err := cfg.SetupLog(); err != nil {
+		log.Fatalf("Error opening log file: %v", err)
+	}
+
+	serverConfig, err := cfg.Server()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	server.RunServer(serverConfig)
 }
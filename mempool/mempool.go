@@ -0,0 +1,308 @@
+package mempool
+
+import (
+	"encoding/hex"
+	"errors"
+	"github.com/duanjr/trustchain/record"
+	"github.com/ethereum/go-ethereum/common"
+	"sort"
+)
+
+var (
+	ErrAlreadyKnown = errors.New("record already pending")
+	ErrUnsigned     = errors.New("record has no signer")
+	ErrSenderLimit  = errors.New("too many pending records from sender")
+	ErrNonceTooLow  = errors.New("nonce too low")
+	ErrStaleRecord  = errors.New("timestamp before sender's last trust submission")
+	ErrPoolFull     = errors.New("mempool full")
+)
+
+// Priority ranks records for inclusion in blocks and for eviction. Higher
+// values go first and are evicted last.
+type Priority func(r *record.Record) int
+
+// KindPriority puts PKI records before trust submissions, since trust is only
+// accepted from registered identities, and both before data records.
+func KindPriority(r *record.Record) int {
+	switch r.Kind {
+	case record.KindPKIRegister, record.KindPKIUpdate, record.KindPKIRevoke:
+		return 2
+	case record.KindTrustSubmit:
+		return 1
+	}
+	return 0
+}
+
+type Config struct {
+	Capacity     int
+	MaxPerSender int
+	Priority     Priority
+}
+
+var DefaultConfig = Config{
+	Capacity:     30000,
+	MaxPerSender: 256,
+	Priority:     KindPriority,
+}
+
+// Entry is a pending record with the data the pool orders it by.
+type Entry struct {
+	Record   *record.Record
+	Hash     common.Hash
+	Sender   string
+	Size     int
+	Priority int
+	seq      uint64
+}
+
+// Pool holds the records waiting for a block, at most one per hash. Data
+// records, whose signatures cover their nonce, must carry increasing nonces
+// per sender, above any of the sender's records already in the chain. Trust
+// submissions, whose signatures cover their timestamp instead, must not go
+// back in time, so an old submission cannot be replayed over a newer value.
+// PKI records sign neither; each is only valid against the key registered
+// when it is applied.
+//
+// Pool does not check records against the state; its owner applies them
+// before adding them.
+type Pool struct {
+	cfg       Config
+	entries   map[common.Hash]*Entry
+	senders   map[string]int
+	nonces    map[sequenceKey]uint64
+	confirmed map[sequenceKey]uint64
+	size      int
+	seq       uint64
+}
+
+func New(cfg Config) *Pool {
+	if cfg.Priority == nil {
+		cfg.Priority = KindPriority
+	}
+	p := &Pool{cfg: cfg, confirmed: make(map[sequenceKey]uint64)}
+	p.Reset()
+	return p
+}
+
+// Reset drops every pending record.
+func (p *Pool) Reset() {
+	p.entries = make(map[common.Hash]*Entry)
+	p.senders = make(map[string]int)
+	p.nonces = make(map[sequenceKey]uint64)
+	p.size = 0
+}
+
+func (p *Pool) Len() int {
+	return len(p.entries)
+}
+
+// Size returns the encoded size of the pending records in bytes.
+func (p *Pool) Size() int {
+	return p.size
+}
+
+func (p *Pool) Capacity() int {
+	return p.cfg.Capacity
+}
+
+func (p *Pool) Has(hash common.Hash) bool {
+	return p.entries[hash] != nil
+}
+
+// Validate checks whether r would be admitted, without adding it.
+func (p *Pool) Validate(r *record.Record) error {
+	if len(r.Signer) == 0 {
+		return ErrUnsigned
+	}
+	if p.Has(r.Hash()) {
+		return ErrAlreadyKnown
+	}
+	sender := hex.EncodeToString(r.Signer)
+	if p.cfg.MaxPerSender > 0 && p.senders[sender] >= p.cfg.MaxPerSender {
+		return ErrSenderLimit
+	}
+	if seq, ok := sequence(r); ok {
+		key := sequenceKey{sender, r.Kind}
+		switch {
+		case r.Kind == record.KindData && (seq <= p.confirmed[key] || seq <= p.nonces[key]):
+			return ErrNonceTooLow
+		case seq < p.confirmed[key] || seq < p.nonces[key]:
+			return ErrStaleRecord
+		}
+	}
+	if p.cfg.Capacity > 0 && len(p.entries) >= p.cfg.Capacity {
+		if lowest := p.lowest(); lowest == nil || p.cfg.Priority(r) <= lowest.Priority {
+			return ErrPoolFull
+		}
+	}
+	return nil
+}
+
+// Add admits r, which must have passed Validate, and returns the records
+// evicted to make room for it.
+func (p *Pool) Add(r *record.Record) []*record.Record {
+	p.insert(r)
+
+	var evicted []*record.Record
+	for p.cfg.Capacity > 0 && len(p.entries) > p.cfg.Capacity {
+		e := p.lowest()
+		p.remove(e)
+		evicted = append(evicted, e.Record)
+	}
+	return evicted
+}
+
+func (p *Pool) insert(r *record.Record) {
+	p.seq++
+	e := &Entry{
+		Record:   r,
+		Hash:     r.Hash(),
+		Sender:   hex.EncodeToString(r.Signer),
+		Size:     len(r.Bytes()),
+		Priority: p.cfg.Priority(r),
+		seq:      p.seq,
+	}
+	p.entries[e.Hash] = e
+	p.senders[e.Sender]++
+	if seq, ok := sequence(r); ok && seq > p.nonces[sequenceKey{e.Sender, r.Kind}] {
+		p.nonces[sequenceKey{e.Sender, r.Kind}] = seq
+	}
+	p.size += e.Size
+}
+
+// Remove drops the given records if pending.
+func (p *Pool) Remove(records []*record.Record) {
+	for _, r := range records {
+		if e := p.entries[r.Hash()]; e != nil {
+			p.remove(e)
+		}
+	}
+}
+
+func (p *Pool) remove(e *Entry) {
+	delete(p.entries, e.Hash)
+	p.senders[e.Sender]--
+	if p.senders[e.Sender] == 0 {
+		delete(p.senders, e.Sender)
+		delete(p.nonces, sequenceKey{e.Sender, record.KindData})
+		delete(p.nonces, sequenceKey{e.Sender, record.KindTrustSubmit})
+	}
+	p.size -= e.Size
+}
+
+// Restore puts records taken for a block that was not sealed back in front
+// of the pool, skipping any that are pending again.
+func (p *Pool) Restore(records []*record.Record) {
+	rest := p.Pending()
+	p.Reset()
+	for _, r := range append(append([]*record.Record{}, records...), rest...) {
+		if !p.Has(r.Hash()) {
+			p.insert(r)
+		}
+	}
+}
+
+// Confirm records that a block with records joined the chain, so that data
+// records may no longer reuse its nonces and trust submissions may no longer
+// predate it.
+func (p *Pool) Confirm(records []*record.Record) {
+	for _, r := range records {
+		seq, ok := sequence(r)
+		if !ok || len(r.Signer) == 0 {
+			continue
+		}
+		key := sequenceKey{hex.EncodeToString(r.Signer), r.Kind}
+		if seq > p.confirmed[key] {
+			p.confirmed[key] = seq
+		}
+	}
+}
+
+// ResetConfirmed forgets every confirmed nonce, before confirming the blocks
+// of a new canonical chain.
+func (p *Pool) ResetConfirmed() {
+	p.confirmed = make(map[sequenceKey]uint64)
+}
+
+// sequenceKey identifies a sender's records of one kind.
+type sequenceKey struct {
+	sender string
+	kind   record.Kind
+}
+
+// sequence returns the signed number that orders a sender's records of r's
+// kind: the nonce of data records and the timestamp of trust submissions.
+// Submissions of the same second may share it.
+func sequence(r *record.Record) (uint64, bool) {
+	switch r.Kind {
+	case record.KindData:
+		return r.Nonce, true
+	case record.KindTrustSubmit:
+		return r.Timestamp, true
+	}
+	return 0, false
+}
+
+// Pending returns the records in the order they were admitted, which is the
+// order the state applied them in.
+func (p *Pool) Pending() []*record.Record {
+	entries := p.sorted(func(a, b *Entry) bool { return a.seq < b.seq })
+	records := make([]*record.Record, len(entries))
+	for i, e := range entries {
+		records[i] = e.Record
+	}
+	return records
+}
+
+// Entries returns the pending entries by priority, highest first and in
+// order of admission within a priority.
+func (p *Pool) Entries() []*Entry {
+	return p.sorted(byPriority)
+}
+
+// Select returns the records for the next block by priority, stopping before
+// maxRecords records or maxBytes bytes are exceeded. A zero limit is not
+// enforced.
+func (p *Pool) Select(maxRecords, maxBytes int) []*record.Record {
+	var records []*record.Record
+	size := 0
+	for _, e := range p.Entries() {
+		if maxRecords > 0 && len(records) >= maxRecords {
+			break
+		}
+		if maxBytes > 0 && size+e.Size > maxBytes {
+			break
+		}
+		records = append(records, e.Record)
+		size += e.Size
+	}
+	return records
+}
+
+// lowest returns the entry evicted first: the lowest priority and, within
+// it, the latest admitted.
+func (p *Pool) lowest() *Entry {
+	var lowest *Entry
+	for _, e := range p.entries {
+		if lowest == nil || byPriority(lowest, e) {
+			lowest = e
+		}
+	}
+	return lowest
+}
+
+func byPriority(a, b *Entry) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	return a.seq < b.seq
+}
+
+func (p *Pool) sorted(less func(a, b *Entry) bool) []*Entry {
+	entries := make([]*Entry, 0, len(p.entries))
+	for _, e := range p.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return less(entries[i], entries[j]) })
+	return entries
+}
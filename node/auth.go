@@ -0,0 +1,110 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/duanjr/trustchain/p2p"
+	"github.com/duanjr/trustchain/record"
+	"github.com/ethereum/go-ethereum/common"
+	"io"
+	"net/http"
+)
+
+type peerIDKey struct{}
+
+// SignResponses signs the body of every response with the node key, so
+// that peers can tell it comes from this node.
+func (n *Node) SignResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := &bufferedResponse{header: w.Header(), status: http.StatusOK}
+		next.ServeHTTP(buf, r)
+		n.p2p.SignResponse(w.Header(), r, buf.body.Bytes())
+		w.WriteHeader(buf.status)
+		w.Write(buf.body.Bytes())
+	})
+}
+
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) Write(data []byte) (int, error) {
+	return b.body.Write(data)
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	b.status = status
+}
+
+// Authenticated serves only requests signed by a node that may be a peer,
+// for the endpoints nodes use among themselves.
+func (n *Node) Authenticated(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, p2p.MaxMessageSize))
+		if err != nil {
+			http.Error(w, "Error reading message", http.StatusBadRequest)
+			return
+		}
+		nodeID, err := n.p2p.VerifyRequest(r, body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		handler(w, r.WithContext(context.WithValue(r.Context(), peerIDKey{}, nodeID)))
+	}
+}
+
+// peerID returns the node that signed an authenticated request.
+func peerID(r *http.Request) string {
+	nodeID, _ := r.Context().Value(peerIDKey{}).(string)
+	return nodeID
+}
+
+// RegisteredKey returns the public key the PKI trie of the head block holds
+// for address, as registered in either lower or mixed case, or nil. Keys
+// that are only pending, or revoked by a pending record, are not considered.
+func (n *Node) RegisteredKey(address string) []byte {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	blocks := n.Blockchain.Blocks
+	head := blocks[len(blocks)-1].Header()
+	for _, a := range []string{address, common.HexToAddress(address).Hex()} {
+		if key, err := n.Blockchain.PKIKey(head, a); err == nil && len(key) > 0 {
+			return key
+		}
+	}
+	return nil
+}
+
+// Certificate returns the identity certificate of the node key.
+func (n *Node) Certificate() (*tls.Certificate, error) {
+	return n.p2p.Certificate()
+}
+
+// PeerTLSConfig returns the TLS configuration of the peer API, or nil if it
+// is served without TLS.
+func (n *Node) PeerTLSConfig() *tls.Config {
+	return n.p2p.TLSConfig()
+}
+
+// VerifyClientCertificate accepts the identity certificates of keys the PKI
+// trie holds, for clients authenticated by their PKI identity.
+func (n *Node) VerifyClientCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	publicKey, err := p2p.CertificateIdentity(rawCerts)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(n.RegisteredKey(record.SignerAddress(publicKey)), publicKey) {
+		return p2p.ErrUnregistered
+	}
+	return nil
+}
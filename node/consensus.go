@@ -0,0 +1,140 @@
+package node
+
+import (
+	"encoding/json"
+	"github.com/duanjr/trustchain/blockchain"
+	"github.com/duanjr/trustchain/consensus"
+	"log"
+	"net/http"
+)
+
+// Node is the consensus.Backend of a BFT engine. Engine calls take n.mu
+// themselves, so the handlers below must not hold it.
+
+func (n *Node) GetHeader(hash []byte) (*blockchain.BlockHeader, int) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.Blockchain.GetHeader(hash)
+}
+
+func (n *Node) PKIKey(header *blockchain.BlockHeader, address string) ([]byte, error) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.Blockchain.PKIKey(header, address)
+}
+
+func (n *Node) Head() (*blockchain.BlockHeader, int) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	blocks := n.Blockchain.Blocks
+	return blocks[len(blocks)-1].Header(), len(blocks) - 1
+}
+
+func (n *Node) Pending() int {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return len(n.Blockchain.PendingRecords())
+}
+
+// Propose seals the block it proposes without holding n.mu.
+func (n *Node) Propose() (*blockchain.Block, error) {
+	n.mu.Lock()
+	job, err := n.Blockchain.ProposeBlock()
+	n.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if err := job.Seal(); err != nil {
+		return nil, err
+	}
+	return job.Block(), nil
+}
+
+func (n *Node) VerifyBlock(block *blockchain.Block) error {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.Blockchain.VerifyBlock(block)
+}
+
+func (n *Node) Commit(block *blockchain.Block) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := n.Blockchain.InsertBlock(block); err != nil {
+		return err
+	}
+	n.announceBlock(block)
+	return nil
+}
+
+func (n *Node) Broadcast(path string, msg interface{}) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Error encoding %s message: %v", path, err)
+		return
+	}
+	for _, peer := range n.peers() {
+		go n.p2p.Send(peer, path, data)
+	}
+}
+
+func (n *Node) bft(w http.ResponseWriter) *consensus.BFT {
+	engine, ok := n.engine.(*consensus.BFT)
+	if !ok {
+		http.Error(w, "Node does not run BFT consensus", http.StatusNotFound)
+	}
+	return engine
+}
+
+func (n *Node) ConsensusProposal(w http.ResponseWriter, r *http.Request) {
+	engine := n.bft(w)
+	if engine == nil {
+		return
+	}
+
+	var proposal consensus.Proposal
+	if err := json.NewDecoder(r.Body).Decode(&proposal); err != nil {
+		http.Error(w, "Invalid proposal", http.StatusBadRequest)
+		return
+	}
+	if err := engine.HandleProposal(&proposal); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (n *Node) ConsensusVote(w http.ResponseWriter, r *http.Request) {
+	engine := n.bft(w)
+	if engine == nil {
+		return
+	}
+
+	var vote consensus.Vote
+	if err := json.NewDecoder(r.Body).Decode(&vote); err != nil {
+		http.Error(w, "Invalid vote", http.StatusBadRequest)
+		return
+	}
+	if err := engine.HandleVote(&vote); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (n *Node) ConsensusCommit(w http.ResponseWriter, r *http.Request) {
+	engine := n.bft(w)
+	if engine == nil {
+		return
+	}
+
+	var block blockchain.Block
+	if err := json.NewDecoder(r.Body).Decode(&block); err != nil {
+		http.Error(w, "Invalid block", http.StatusBadRequest)
+		return
+	}
+	if err := engine.HandleCommit(&block); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,221 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/duanjr/trustchain/blockchain"
+	"github.com/duanjr/trustchain/p2p"
+	"github.com/duanjr/trustchain/record"
+	"github.com/ethereum/go-ethereum/common"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// gossipFanout is how many peers a record or block is sent to. Each
+	// peer relays what it accepts, so the rest of the network is reached in
+	// a few hops.
+	gossipFanout = 8
+	// seenCacheSize is how many recent record and block hashes a node
+	// remembers in order to relay each only once.
+	seenCacheSize = 1 << 14
+	// gossipQueueSize is how many messages may wait for a peer before new
+	// ones to it are dropped.
+	gossipQueueSize = 1024
+)
+
+// seenCache is a fixed-size set of hashes, forgetting the oldest first.
+type seenCache struct {
+	mu   sync.Mutex
+	set  map[common.Hash]struct{}
+	ring []common.Hash
+	next int
+}
+
+func newSeenCache(size int) *seenCache {
+	return &seenCache{set: make(map[common.Hash]struct{}, size), ring: make([]common.Hash, size)}
+}
+
+func (c *seenCache) has(hash common.Hash) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.set[hash]
+	return ok
+}
+
+// add marks hash as seen and reports whether it was not already.
+func (c *seenCache) add(hash common.Hash) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.set[hash]; ok {
+		return false
+	}
+	if old := c.ring[c.next]; old != (common.Hash{}) {
+		delete(c.set, old)
+	}
+	c.ring[c.next] = hash
+	c.next = (c.next + 1) % len(c.ring)
+	c.set[hash] = struct{}{}
+	return true
+}
+
+// addRecord admits a record and announces it to peers. The caller must hold
+// n.mu.
+func (n *Node) addRecord(rec *record.Record) error {
+	if err := n.Blockchain.AddRecord(rec); err != nil {
+		return err
+	}
+	n.announce("/gossip/record", rec.Hash(), rec)
+	return nil
+}
+
+// announce queues msg for up to gossipFanout random peers, unless hash was
+// already announced.
+func (n *Node) announce(path string, hash common.Hash, msg interface{}) {
+	if !n.seen.add(hash) {
+		return
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Error encoding %s message: %v", path, err)
+		return
+	}
+
+	peers := n.peers()
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	if len(peers) > gossipFanout {
+		peers = peers[:gossipFanout]
+	}
+	for _, peer := range peers {
+		n.enqueue(peer, gossipMessage{path: path, data: data})
+	}
+}
+
+type gossipMessage struct {
+	path string
+	data []byte
+}
+
+// enqueue adds msg to the queue of messages to peer, starting its sender on
+// first use, or drops it if the queue is full. Messages to a peer are sent
+// one at a time, so that it receives a sender's records in nonce order.
+func (n *Node) enqueue(peer string, msg gossipMessage) {
+	n.queuesMu.Lock()
+	defer n.queuesMu.Unlock()
+	queue := n.queues[peer]
+	if queue == nil {
+		queue = make(chan gossipMessage, gossipQueueSize)
+		n.queues[peer] = queue
+		go n.sendGossip(peer, queue)
+	}
+	select {
+	case queue <- msg:
+	default:
+		log.Printf("Dropping %s message to slow peer %s", msg.path, peer)
+	}
+}
+
+// dropQueue closes the queue of a peer the peer manager dropped, so that its
+// sender exits once the messages already queued are sent.
+func (n *Node) dropQueue(peer string) {
+	n.queuesMu.Lock()
+	defer n.queuesMu.Unlock()
+	if queue := n.queues[peer]; queue != nil {
+		close(queue)
+		delete(n.queues, peer)
+	}
+}
+
+// sendGossip posts the messages queued for peer.
+func (n *Node) sendGossip(peer string, queue <-chan gossipMessage) {
+	for msg := range queue {
+		n.p2p.Send(peer, msg.path, msg.data)
+	}
+}
+
+// GossipRecord admits a record announced by a peer and relays it if it is
+// new and valid. Records that are not valid here are not relayed.
+func (n *Node) GossipRecord(w http.ResponseWriter, r *http.Request) {
+	var rec record.Record
+	if err := json.NewDecoder(r.Body).Decode(&rec); err != nil {
+		http.Error(w, "Invalid record", http.StatusBadRequest)
+		return
+	}
+	if n.seen.has(rec.Hash()) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err := rec.Verify(); err != nil {
+		n.p2p.PenalizeNode(peerID(r), p2p.PenaltyInvalidRecord)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := n.admit(&rec); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GossipBlock imports a block announced by a peer and relays it if it is new
+// and valid. A block whose parent is unknown makes the node catch up from its
+// peers instead.
+func (n *Node) GossipBlock(w http.ResponseWriter, r *http.Request) {
+	var block blockchain.Block
+	if err := json.NewDecoder(r.Body).Decode(&block); err != nil {
+		http.Error(w, "Invalid block", http.StatusBadRequest)
+		return
+	}
+	hash := common.BytesToHash(block.Hash)
+	if n.seen.has(hash) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// The header is checked holding the chain only for reading, so that
+	// blocks failing their proof of work or signature never wait for it.
+	n.mu.RLock()
+	err := n.Blockchain.VerifyHeader(&block)
+	n.mu.RUnlock()
+	if err == nil {
+		n.mu.Lock()
+		err = n.Blockchain.InsertVerifiedBlock(&block)
+		if err == nil {
+			n.announceBlock(&block)
+		}
+		n.mu.Unlock()
+	}
+
+	if errors.Is(err, blockchain.ErrUnknownParent) {
+		go n.catchUp()
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	if err != nil {
+		if errors.Is(err, blockchain.ErrInvalidBlock) {
+			n.p2p.PenalizeNode(peerID(r), p2p.PenaltyInvalidBlock)
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// announceBlock gossips a block this node sealed. The caller must hold n.mu.
+func (n *Node) announceBlock(block *blockchain.Block) {
+	n.announce("/gossip/block", common.BytesToHash(block.Hash), block)
+}
+
+// catchUp synchronizes with the peers unless a synchronization is already
+// running.
+func (n *Node) catchUp() {
+	if !atomic.CompareAndSwapInt32(&n.syncing, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&n.syncing, 0)
+	n.SynchronizeBlockchain()
+}
@@ -0,0 +1,58 @@
+package node
+
+import (
+	"encoding/json"
+	"github.com/duanjr/trustchain/mempool"
+	"github.com/duanjr/trustchain/record"
+	"net/http"
+)
+
+// SetMempool replaces the mempool configuration of the node's chains.
+func (n *Node) SetMempool(cfg mempool.Config) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.mempool = cfg
+	n.Blockchain.SetMempool(cfg)
+}
+
+type MempoolEntry struct {
+	Hash     string `json:"hash"`
+	Kind     string `json:"kind"`
+	Sender   string `json:"sender"`
+	Nonce    uint64 `json:"nonce"`
+	Size     int    `json:"size"`
+	Priority int    `json:"priority"`
+}
+
+type MempoolResponse struct {
+	Count    int            `json:"count"`
+	Bytes    int            `json:"bytes"`
+	Capacity int            `json:"capacity"`
+	Records  []MempoolEntry `json:"records"`
+}
+
+func (n *Node) GetMempool(w http.ResponseWriter, r *http.Request) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	entries := n.Blockchain.Mempool()
+	resp := MempoolResponse{
+		Count:    len(entries),
+		Bytes:    n.Blockchain.PendingSize(),
+		Capacity: n.Blockchain.MempoolCapacity(),
+		Records:  make([]MempoolEntry, len(entries)),
+	}
+	for i, e := range entries {
+		resp.Records[i] = MempoolEntry{
+			Hash:     e.Hash.Hex(),
+			Kind:     e.Record.Kind.String(),
+			Sender:   record.SignerAddress(e.Record.Signer),
+			Nonce:    e.Record.Nonce,
+			Size:     e.Size,
+			Priority: e.Priority,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
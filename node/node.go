@@ -1,85 +1,165 @@
 package node
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/duanjr/trustchain/blockchain"
+	"github.com/duanjr/trustchain/mempool"
+	"github.com/duanjr/trustchain/p2p"
 	"github.com/duanjr/trustchain/pki"
+	"github.com/duanjr/trustchain/record"
 	"github.com/duanjr/trustchain/trust"
+	"github.com/gorilla/mux"
 	"net/http"
 	"strconv"
+	"sync"
 )
 
+// Node serves one blockchain. mu guards the chain: state changes hold it for
+// writing, and readers hold it for reading and never look keys up in the live
+// tries, which caches nodes in them. Peers are kept by the p2p manager, which
+// has its own lock.
 type Node struct {
 	Blockchain *blockchain.Blockchain
-	Peers      []string
+	registry   *pki.Registry
+	trust      *trust.Engine
+	engine     blockchain.Engine
+	producer   blockchain.ProducerConfig
+	mempool    mempool.Config
+	p2p        *p2p.Manager
+	seen       *seenCache
+	syncing    int32
+	queues     map[string]chan gossipMessage
+	queuesMu   sync.Mutex
+	mu         sync.RWMutex
 }
 
-func NewNode() *Node {
-	res := &Node{blockchain.NewBlockchain(), []string{}}
-	pki.Initialize(res.Blockchain.PkiTrie)
-	trust.Initialize(res.Blockchain.DirectTrustTrie, res.Blockchain.PkiTrie, res.Blockchain.CompTrustTrie,
-		res.Blockchain.Id2DT, res.Blockchain.AddressList)
-	return res
+func NewNode(dataDir string, engine blockchain.Engine, genesis *blockchain.Genesis, params blockchain.TrustParams) (*Node, error) {
+	db, err := blockchain.OpenDatabase(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	bc, err := blockchain.NewBlockchain(db, engine, genesis, params)
+	if err != nil {
+		return nil, err
+	}
+	res := &Node{engine: engine, mempool: mempool.DefaultConfig, seen: newSeenCache(seenCacheSize), queues: make(map[string]chan gossipMessage)}
+	res.setBlockchain(bc)
+	res.p2p, err = p2p.New(db, res)
+	if err != nil {
+		return nil, err
+	}
+	res.p2p.OnDrop(res.dropQueue)
+	return res, nil
 }
 
 func (n *Node) AddRecord(w http.ResponseWriter, r *http.Request) {
-	var record string
+	var encoded string
 
-	if _, err := fmt.Fscanf(r.Body, "%s", &record); err != nil {
+	if _, err := fmt.Fscanf(r.Body, "%s", &encoded); err != nil {
 		http.Error(w, "Error reading record", http.StatusBadRequest)
 		return
 	}
 
-	n.Blockchain.AddRecord(record)
+	data, err := hex.DecodeString(encoded)
+	if err != nil {
+		http.Error(w, "Invalid record encoding", http.StatusBadRequest)
+		return
+	}
+	rec, err := record.Decode(data)
+	if err != nil {
+		http.Error(w, "Invalid record encoding", http.StatusBadRequest)
+		return
+	}
+	if rec.Kind != record.KindData {
+		http.Error(w, "Only data records can be added directly", http.StatusBadRequest)
+		return
+	}
+	if err := rec.Verify(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := n.admit(rec); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// admit adds a record whose signatures were verified to the chain, holding
+// n.mu only for the state transition.
+func (n *Node) admit(rec *record.Record) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.addRecord(rec)
+}
+
 func (n *Node) GetBlockchain(w http.ResponseWriter, r *http.Request) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(n.Blockchain.Blocks)
 }
 
-func (n *Node) AddPeer(peer string) {
-	n.Peers = append(n.Peers, peer)
+type RecordProofResponse struct {
+	Record *record.Record          `json:"record"`
+	Proof  *blockchain.MerkleProof `json:"proof"`
+	Header *blockchain.BlockHeader `json:"header"`
+	Hash   string                  `json:"hash"`
 }
 
-func (n *Node) AddPeerHandler(w http.ResponseWriter, r *http.Request) {
-	var peer string
+func (n *Node) GetRecordProof(w http.ResponseWriter, r *http.Request) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
 
-	if _, err := fmt.Fscanf(r.Body, "%s", &peer); err != nil {
-		http.Error(w, "Error reading peer", http.StatusBadRequest)
+	vars := mux.Vars(r)
+	hash, err := hex.DecodeString(vars["hash"])
+	if err != nil {
+		http.Error(w, "Invalid block hash", http.StatusBadRequest)
+		return
+	}
+	index, err := strconv.Atoi(vars["index"])
+	if err != nil {
+		http.Error(w, "Invalid record index", http.StatusBadRequest)
 		return
 	}
 
-	n.AddPeer(peer)
-	w.WriteHeader(http.StatusNoContent)
-}
-
-func (n *Node) replaceBlockchain(newBlocks []*blockchain.Block) {
-	newChain := blockchain.NewBlockchainWithBlocks(newBlocks)
-
-	if len(newChain.Blocks) > len(n.Blockchain.Blocks) && newChain.IsValid() {
-		n.Blockchain = newChain
+	block := n.Blockchain.GetBlock(hash)
+	if block == nil {
+		http.Error(w, "No such block", http.StatusNotFound)
+		return
+	}
+	proof, err := block.RecordProof(index)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
 	}
-}
 
-func (n *Node) SynchronizeBlockchain() {
-	for _, peer := range n.Peers {
-		resp, err := http.Get(fmt.Sprintf("http://%s/blocks", peer))
-		if err != nil {
-			continue
-		}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RecordProofResponse{
+		Record: block.Records[index],
+		Proof:  proof,
+		Header: block.Header(),
+		Hash:   hex.EncodeToString(block.Hash),
+	})
+}
 
-		var blocks []*blockchain.Block
-		err = json.NewDecoder(resp.Body).Decode(&blocks)
-		resp.Body.Close()
-		if err != nil {
-			continue
-		}
+// setBlockchain swaps the chain the pki and trust handlers read the state
+// of. The caller must hold n.mu.
+func (n *Node) setBlockchain(bc *blockchain.Blockchain) {
+	n.Blockchain = bc
+	bc.SetProducer(n.producer)
+	bc.SetMempool(n.mempool)
+	n.registry = pki.NewRegistry(n.state)
+	n.trust = trust.NewEngine(n.state)
+}
 
-		n.replaceBlockchain(blocks)
-	}
+// state returns the current state of the chain. The caller must hold n.mu.
+func (n *Node) state() *blockchain.State {
+	return n.Blockchain.State
 }
 
 func (n *Node) AddPKIRecord(w http.ResponseWriter, r *http.Request) {
@@ -89,14 +169,16 @@ func (n *Node) AddPKIRecord(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Error decoding JSON", http.StatusBadRequest)
 		return
 	}
-	success, record := pki.Register(pkiReq.PublicKey, pkiReq.Signature, pkiReq.Address)
-	if success {
-		n.Blockchain.AddRecord(record)
+	rec, err := n.registry.Register(pkiReq.PublicKey, pkiReq.Signature, pkiReq.Address)
+	if err == nil {
+		err = n.admit(rec)
+	}
+	if err == nil {
 		w.WriteHeader(http.StatusCreated)
 		w.Header().Set("Content-Type", "text/plain")
 		_, _ = w.Write([]byte("Registered successfully"))
 	} else {
-		http.Error(w, record, http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 	}
 }
 
@@ -108,13 +190,16 @@ func (n *Node) UpdatePKIRecord(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	success, msg := pki.Update(updateReq.PublicKey1, updateReq.Signature1, updateReq.PublicKey2, updateReq.Signature2, updateReq.Address)
-	if success {
+	rec, err := n.registry.Update(updateReq.PublicKey1, updateReq.Signature1, updateReq.PublicKey2, updateReq.Signature2, updateReq.Address)
+	if err == nil {
+		err = n.admit(rec)
+	}
+	if err == nil {
 		w.WriteHeader(http.StatusCreated)
 		w.Header().Set("Content-Type", "text/plain")
 		_, _ = w.Write([]byte("Updated successfully"))
 	} else {
-		http.Error(w, msg, http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 	}
 }
 
@@ -126,7 +211,15 @@ func (n *Node) QueryPKIRecord(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	publicKey, err := pki.Query(pkiReq.Address)
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	if pkiReq.Proof {
+		n.queryPKIProof(w, pkiReq.Address)
+		return
+	}
+
+	publicKey, err := n.registry.Query(pkiReq.Address)
 	if err != nil {
 		http.Error(w, "No such identity", http.StatusBadRequest)
 	} else {
@@ -134,6 +227,27 @@ func (n *Node) QueryPKIRecord(w http.ResponseWriter, r *http.Request) {
 		_, _ = w.Write([]byte(publicKey))
 	}
 }
+
+func (n *Node) queryPKIProof(w http.ResponseWriter, address string) {
+	if address == "" {
+		http.Error(w, "Missing address", http.StatusBadRequest)
+		return
+	}
+
+	value, proof, err := n.Blockchain.ProvePKI(address)
+	if err != nil {
+		http.Error(w, "Error building proof", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pki.QueryProofResponse{
+		Address:   address,
+		PublicKey: hex.EncodeToString(value),
+		Proof:     proof,
+	})
+}
+
 func (n *Node) RevokePKIRecord(w http.ResponseWriter, r *http.Request) {
 	var pkiReq pki.RevokeRequest
 	err := json.NewDecoder(r.Body).Decode(&pkiReq)
@@ -141,14 +255,16 @@ func (n *Node) RevokePKIRecord(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Error decoding JSON", http.StatusBadRequest)
 		return
 	}
-	success, record := pki.Revoke(pkiReq.PublicKey, pkiReq.Signature, pkiReq.Address)
-	if success {
-		n.Blockchain.AddRecord(record)
+	rec, err := n.registry.Revoke(pkiReq.PublicKey, pkiReq.Signature, pkiReq.Address)
+	if err == nil {
+		err = n.admit(rec)
+	}
+	if err == nil {
 		w.WriteHeader(http.StatusCreated)
 		w.Header().Set("Content-Type", "text/plain")
 		_, _ = w.Write([]byte("Revoked successfully"))
 	} else {
-		http.Error(w, record, http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 	}
 }
 
@@ -160,7 +276,10 @@ func (n *Node) TrustSubmitRecord(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = trust.Submit(req)
+	rec, err := n.trust.Submit(req)
+	if err == nil {
+		err = n.admit(rec)
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -177,7 +296,15 @@ func (n *Node) DirectTrustQueryRecord(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	trustValue, err := trust.QueryDirect(req)
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	if req.Proof {
+		n.queryTrustProof(w, trust.KindDirect, req)
+		return
+	}
+
+	trustValue, err := n.trust.QueryDirect(req)
 	if err != nil {
 		http.Error(w, "No such identity", http.StatusBadRequest)
 	} else {
@@ -194,7 +321,15 @@ func (n *Node) CompTrustQuery(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	trustValue, err := trust.QueryComp(req)
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	if req.Proof {
+		n.queryTrustProof(w, trust.KindComp, req)
+		return
+	}
+
+	trustValue, err := n.trust.QueryComp(req)
 	if err != nil {
 		http.Error(w, "No such identity", http.StatusBadRequest)
 	} else {
@@ -203,6 +338,37 @@ func (n *Node) CompTrustQuery(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (n *Node) queryTrustProof(w http.ResponseWriter, kind string, req trust.QueryRequest) {
+	if req.AddressI == "" || req.AddressJ == "" {
+		http.Error(w, "Missing address", http.StatusBadRequest)
+		return
+	}
+	blockHash, err := hex.DecodeString(req.Block)
+	if err != nil {
+		http.Error(w, "Invalid block hash", http.StatusBadRequest)
+		return
+	}
+
+	prove := n.Blockchain.ProveDirectTrust
+	if kind == trust.KindComp {
+		prove = n.Blockchain.ProveCompTrust
+	}
+	value, proof, err := prove(blockHash, req.AddressI, req.AddressJ)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(trust.QueryProofResponse{
+		Kind:       kind,
+		AddressI:   req.AddressI,
+		AddressJ:   req.AddressJ,
+		TrustValue: string(value),
+		Proof:      proof,
+	})
+}
+
 func (n *Node) CalcCompTrustQuery(w http.ResponseWriter, r *http.Request) {
 	var req trust.QueryRequest
 	err := json.NewDecoder(r.Body).Decode(&req)
@@ -211,7 +377,10 @@ func (n *Node) CalcCompTrustQuery(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	trustValue := n.Blockchain.CompTrust(req.AddressI, req.AddressJ)
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	trustValue := n.trust.Calculate(req)
 
 	w.Header().Set("Content-Type", "text/plain")
 	_, _ = w.Write([]byte(strconv.FormatFloat(trustValue, 'f', -1, 64)))
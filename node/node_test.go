@@ -0,0 +1,163 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/duanjr/trustchain/blockchain"
+	"github.com/duanjr/trustchain/consensus"
+	"github.com/duanjr/trustchain/p2p"
+	"github.com/duanjr/trustchain/pki"
+	"github.com/duanjr/trustchain/record"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type testNode struct {
+	*Node
+	address string
+}
+
+// newTestNode starts a node with an in-memory chain whose proof-of-work is
+// trivial, serving the peer API on a local port.
+func newTestNode(t testing.TB) *testNode {
+	engine := consensus.NewPoW(consensus.PoWParams{MinTargetBits: 1, MaxTargetBits: 1, RetargetInterval: 10, TargetBlockInterval: time.Second})
+	n, err := NewNode("", engine, &blockchain.Genesis{TargetBits: 1}, blockchain.DefaultTrustParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	router.Use(n.SignResponses)
+	router.HandleFunc("/blocks/{hash}", n.Authenticated(n.GetBlock)).Methods("GET")
+	router.HandleFunc("/headers", n.Authenticated(n.GetHeaders)).Methods("GET")
+	router.HandleFunc("/status", n.Authenticated(n.GetStatus)).Methods("GET")
+	router.HandleFunc("/peers", n.Authenticated(n.GetPeers)).Methods("GET")
+	router.HandleFunc("/p2p/handshake", n.Authenticated(n.Handshake)).Methods("POST")
+	router.HandleFunc("/gossip/record", n.Authenticated(n.GossipRecord)).Methods("POST")
+	router.HandleFunc("/gossip/block", n.Authenticated(n.GossipBlock)).Methods("POST")
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	address := server.Listener.Addr().String()
+	cfg := p2p.DefaultConfig
+	cfg.ChainID = "test"
+	cfg.Address = address
+	cfg.PingInterval = time.Hour
+	n.SetPeerConfig(cfg)
+	n.mu.Lock()
+	n.producer = blockchain.ProducerConfig{Interval: time.Millisecond, EmptyBlocks: true}
+	n.Blockchain.SetProducer(n.producer)
+	n.mu.Unlock()
+	return &testNode{Node: n, address: address}
+}
+
+// serve calls handler with a request of body encoded as JSON and returns the
+// response.
+func serve(handler http.HandlerFunc, body interface{}) *httptest.ResponseRecorder {
+	data, _ := json.Marshal(body)
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(data)))
+	return w
+}
+
+func newKey(t testing.TB) (*ecdsa.PrivateKey, string) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, record.SignerAddress(crypto.FromECDSAPub(&key.PublicKey))
+}
+
+func registerRequest(t testing.TB) (pki.RegisterRequest, *ecdsa.PrivateKey) {
+	key, address := newKey(t)
+	return registerRequestFor(t, key, address), key
+}
+
+func registerRequestFor(t testing.TB, key *ecdsa.PrivateKey, address string) pki.RegisterRequest {
+	signature, err := crypto.Sign(crypto.Keccak256([]byte("register"+address)), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pki.RegisterRequest{
+		PublicKey: hex.EncodeToString(crypto.FromECDSAPub(&key.PublicKey)),
+		Signature: base64.StdEncoding.EncodeToString(signature),
+		Address:   address,
+	}
+}
+
+// query returns the public key n holds for address, or "".
+func (n *testNode) query(address string) string {
+	w := serve(n.QueryPKIRecord, pki.QueryRequest{Address: address})
+	if w.Code != http.StatusOK {
+		return ""
+	}
+	return w.Body.String()
+}
+
+func (n *testNode) height() int {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return len(n.Blockchain.Blocks) - 1
+}
+
+// produceBlock seals a block of the pending records and announces it.
+func (n *testNode) produceBlock(t testing.TB) {
+	n.mu.Lock()
+	job, err := n.Blockchain.StartBlock(context.Background(), time.Now())
+	n.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job != nil {
+		n.sealBlock(job)
+	}
+}
+
+func eventually(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNodesInOneProcess(t *testing.T) {
+	a, b, c := newTestNode(t), newTestNode(t), newTestNode(t)
+	if err := a.AddPeer(b.address); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := registerRequest(t)
+	if w := serve(a.AddPKIRecord, req); w.Code != http.StatusCreated {
+		t.Fatalf("registration refused: %s", w.Body)
+	}
+	if got := a.query(req.Address); got != req.PublicKey {
+		t.Fatalf("registering node holds %q, want %q", got, req.PublicKey)
+	}
+	eventually(t, "the registration reaches the peer", func() bool {
+		return b.query(req.Address) == req.PublicKey
+	})
+
+	a.produceBlock(t)
+	eventually(t, "the peer imports the block", func() bool {
+		return b.height() == 1
+	})
+	for _, n := range []*testNode{a, b} {
+		if got := n.query(req.Address); got != req.PublicKey {
+			t.Errorf("after the block, %s holds %q, want %q", n.address, got, req.PublicKey)
+		}
+	}
+	if got := c.query(req.Address); got != "" {
+		t.Errorf("unconnected node holds %q", got)
+	}
+}
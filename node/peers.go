@@ -0,0 +1,87 @@
+package node
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"github.com/duanjr/trustchain/p2p"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SetPeerConfig replaces the configuration of the peer manager.
+func (n *Node) SetPeerConfig(cfg p2p.Config) {
+	n.p2p.SetConfig(cfg)
+}
+
+func (n *Node) ChainStatus() (string, int) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	blocks := n.Blockchain.Blocks
+	return hex.EncodeToString(blocks[0].Hash), len(blocks) - 1
+}
+
+func (n *Node) peers() []string {
+	return n.p2p.Active()
+}
+
+// AddPeer connects to the node at peer and catches up with it.
+func (n *Node) AddPeer(peer string) error {
+	if err := n.p2p.Connect(peer); err != nil {
+		return err
+	}
+	go n.catchUp()
+	return nil
+}
+
+func (n *Node) AddPeerHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 256))
+	if err != nil {
+		http.Error(w, "Error reading peer", http.StatusBadRequest)
+		return
+	}
+
+	if err := n.AddPeer(strings.TrimSpace(string(body))); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handshake answers a node connecting to this one with this node's
+// handshake, or refuses it.
+func (n *Node) Handshake(w http.ResponseWriter, r *http.Request) {
+	var h p2p.Handshake
+	if err := json.NewDecoder(r.Body).Decode(&h); err != nil {
+		http.Error(w, "Invalid handshake", http.StatusBadRequest)
+		return
+	}
+	added, err := n.p2p.Accept(&h, peerID(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if added {
+		go n.catchUp()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(n.p2p.Handshake())
+}
+
+// GetPeers serves the addresses of the active peers, for peer exchange.
+func (n *Node) GetPeers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(append([]string{}, n.peers()...))
+}
+
+// RunPeers keeps the peer list up to date and catches up with new peers.
+func (n *Node) RunPeers() {
+	for {
+		if added := n.p2p.Maintain(); len(added) > 0 {
+			go n.catchUp()
+		}
+		time.Sleep(n.p2p.PingInterval())
+	}
+}
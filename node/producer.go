@@ -0,0 +1,91 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/duanjr/trustchain/blockchain"
+	"github.com/duanjr/trustchain/consensus"
+	"log"
+	"net/http"
+	"time"
+)
+
+const producerTick = time.Second
+
+// RunProducer seals blocks of the pending records as cfg dictates until the
+// process exits.
+func (n *Node) RunProducer(cfg blockchain.ProducerConfig) {
+	n.mu.Lock()
+	n.producer = cfg
+	n.Blockchain.SetProducer(cfg)
+	n.mu.Unlock()
+
+	for now := range time.Tick(producerTick) {
+		n.mu.Lock()
+		job, err := n.Blockchain.StartBlock(context.Background(), now)
+		n.mu.Unlock()
+		if err != nil {
+			if !errors.Is(err, consensus.ErrNotProposer) {
+				log.Printf("Error producing block: %v", err)
+			}
+			continue
+		}
+		if job != nil {
+			go n.sealBlock(job)
+		}
+	}
+}
+
+// sealBlock seals a block off the request path. Records keep being accepted
+// meanwhile, and a peer block at the same height aborts it.
+func (n *Node) sealBlock(job *blockchain.SealJob) {
+	err := job.Seal()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := n.Blockchain.FinishBlock(job, err); err != nil {
+		if !errors.Is(err, context.Canceled) {
+			log.Printf("Error sealing block: %v", err)
+		}
+		return
+	}
+	// A job aborted after sealing is dropped without an error.
+	if block := job.Block(); block != nil && n.Blockchain.GetBlock(block.Hash) != nil {
+		n.announceBlock(block)
+	}
+}
+
+type NextBlock struct {
+	Height     int    `json:"height"`
+	Proposer   string `json:"proposer,omitempty"`
+	ExpectedAt *int64 `json:"expectedAt"`
+}
+
+type PendingResponse struct {
+	Pending   int       `json:"pending"`
+	Bytes     int       `json:"bytes"`
+	NextBlock NextBlock `json:"nextBlock"`
+}
+
+func (n *Node) GetPending(w http.ResponseWriter, r *http.Request) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	height := len(n.Blockchain.Blocks)
+	resp := PendingResponse{
+		Pending: len(n.Blockchain.PendingRecords()),
+		Bytes:   n.Blockchain.PendingSize(),
+		NextBlock: NextBlock{
+			Height:   height,
+			Proposer: n.engine.Proposer(height),
+		},
+	}
+	if due, ok := n.Blockchain.NextBlockTime(); ok {
+		expectedAt := due.Unix()
+		resp.NextBlock.ExpectedAt = &expectedAt
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,116 @@
+package node
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/duanjr/trustchain/pki"
+	"github.com/duanjr/trustchain/record"
+	"github.com/duanjr/trustchain/trust"
+	"github.com/ethereum/go-ethereum/crypto"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const stressRounds = 20
+
+// TestConcurrentRequests runs every kind of request a node serves at once, so
+// that go test -race sees the handlers, block production and block import
+// share the node's state.
+func TestConcurrentRequests(t *testing.T) {
+	n, other := newTestNode(t), newTestNode(t)
+
+	var wg sync.WaitGroup
+	run := func(f func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < stressRounds; i++ {
+				f(i)
+			}
+		}()
+	}
+
+	dataKey, _ := newKey(t)
+	run(func(i int) {
+		r := record.NewData([]byte(fmt.Sprint(i)), uint64(i+1), uint64(time.Now().Unix()))
+		if err := r.Sign(dataKey); err != nil {
+			t.Error(err)
+			return
+		}
+		w := httptest.NewRecorder()
+		n.AddRecord(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(hex.EncodeToString(r.Bytes()))))
+		if w.Code != http.StatusNoContent {
+			t.Errorf("data record %d refused: %s", i, w.Body)
+		}
+	})
+
+	var registered []string
+	var registeredMu sync.Mutex
+	run(func(i int) {
+		req, _ := registerRequest(t)
+		if w := serve(n.AddPKIRecord, req); w.Code != http.StatusCreated {
+			t.Errorf("registration refused: %s", w.Body)
+			return
+		}
+		registeredMu.Lock()
+		registered = append(registered, req.Address)
+		registeredMu.Unlock()
+		serve(n.QueryPKIRecord, pki.QueryRequest{Address: req.Address})
+	})
+
+	truster, from := newKey(t)
+	if w := serve(n.AddPKIRecord, registerRequestFor(t, truster, from)); w.Code != http.StatusCreated {
+		t.Fatalf("registration refused: %s", w.Body)
+	}
+	run(func(i int) {
+		_, to := newKey(t)
+		timestamp := time.Now().Unix()
+		msg, err := record.TrustMessage(from, to, 0.5, timestamp)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		signature, err := crypto.Sign(crypto.Keccak256([]byte(msg)), truster)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		req := trust.SubmitRequest{AddressI: from, AddressJ: to, TrustValue: 0.5, Timestamp: timestamp, Signature: base64.StdEncoding.EncodeToString(signature)}
+		if w := serve(n.TrustSubmitRecord, req); w.Code != http.StatusCreated {
+			t.Errorf("trust submission refused: %s", w.Body)
+		}
+		query := trust.QueryRequest{AddressI: from, AddressJ: to}
+		serve(n.DirectTrustQueryRecord, query)
+		serve(n.CompTrustQuery, query)
+		serve(n.CalcCompTrustQuery, query)
+	})
+
+	run(func(int) { n.produceBlock(t) })
+
+	run(func(int) {
+		other.produceBlock(t)
+		other.mu.RLock()
+		block := other.Blockchain.Blocks[len(other.Blockchain.Blocks)-1]
+		other.mu.RUnlock()
+		n.Commit(block)
+	})
+
+	run(func(int) {
+		for _, handler := range []http.HandlerFunc{n.GetBlockchain, n.GetPending, n.GetMempool, n.GetStatus} {
+			w := httptest.NewRecorder()
+			handler(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		}
+	})
+
+	wg.Wait()
+	for _, address := range registered {
+		if n.query(address) == "" {
+			t.Errorf("registration of %s lost", address)
+		}
+	}
+}
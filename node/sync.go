@@ -0,0 +1,317 @@
+package node
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/duanjr/trustchain/blockchain"
+	"github.com/duanjr/trustchain/p2p"
+	"github.com/gorilla/mux"
+	"log"
+	"math/big"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+const (
+	// maxHeaders is the most headers served or fetched in one request.
+	maxHeaders = 192
+	// maxBlockFetches is how many blocks are downloaded at the same time.
+	maxBlockFetches = 16
+)
+
+type StatusResponse struct {
+	Genesis   string `json:"genesis"`
+	Height    int    `json:"height"`
+	Hash      string `json:"hash"`
+	TotalWork string `json:"totalWork"`
+}
+
+func (n *Node) GetStatus(w http.ResponseWriter, r *http.Request) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	blocks := n.Blockchain.Blocks
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(StatusResponse{
+		Genesis:   hex.EncodeToString(blocks[0].Hash),
+		Height:    len(blocks) - 1,
+		Hash:      hex.EncodeToString(blocks[len(blocks)-1].Hash),
+		TotalWork: n.Blockchain.TotalWork().String(),
+	})
+}
+
+// GetHeaders serves up to count, and at most maxHeaders, canonical headers
+// from height from on.
+func (n *Node) GetHeaders(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	from, err := strconv.Atoi(query.Get("from"))
+	if err != nil || from < 0 {
+		http.Error(w, "Invalid height", http.StatusBadRequest)
+		return
+	}
+	count := maxHeaders
+	if query.Get("count") != "" {
+		count, err = strconv.Atoi(query.Get("count"))
+		if err != nil || count <= 0 {
+			http.Error(w, "Invalid count", http.StatusBadRequest)
+			return
+		}
+	}
+	if count > maxHeaders {
+		count = maxHeaders
+	}
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	headers := []*blockchain.BlockHeader{}
+	for height := from; height < len(n.Blockchain.Blocks) && len(headers) < count; height++ {
+		headers = append(headers, n.Blockchain.Blocks[height].Header())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(headers)
+}
+
+// GetBlock serves a known block by hash, whether canonical or not.
+func (n *Node) GetBlock(w http.ResponseWriter, r *http.Request) {
+	hash, err := hex.DecodeString(mux.Vars(r)["hash"])
+	if err != nil {
+		http.Error(w, "Invalid block hash", http.StatusBadRequest)
+		return
+	}
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	block := n.Blockchain.GetBlock(hash)
+	if block == nil {
+		http.Error(w, "No such block", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(block)
+}
+
+// SynchronizeBlockchain catches up with every peer whose chain has more work
+// than the node's.
+func (n *Node) SynchronizeBlockchain() {
+	for _, peer := range n.peers() {
+		if err := n.syncWith(peer); err != nil {
+			log.Printf("Error synchronizing with %s: %v", peer, err)
+		}
+	}
+}
+
+// syncWith downloads the blocks of peer's chain after the last one the node
+// has, in batches: the headers of a batch are fetched from peer and checked
+// first, then their blocks are fetched from all peers and imported.
+func (n *Node) syncWith(peer string) error {
+	var status StatusResponse
+	if err := n.p2p.GetJSON(peer, "/status", &status); err != nil {
+		return err
+	}
+	work, ok := new(big.Int).SetString(status.TotalWork, 10)
+	if !ok {
+		return errors.New("invalid total work")
+	}
+
+	n.mu.RLock()
+	genesis := hex.EncodeToString(n.Blockchain.Blocks[0].Hash)
+	ahead := work.Cmp(n.Blockchain.TotalWork()) > 0
+	n.mu.RUnlock()
+	if !ahead {
+		return nil
+	}
+	if status.Genesis != genesis {
+		return p2p.ErrGenesis
+	}
+
+	height, parent, err := n.findAncestor(peer, status.Height)
+	if err != nil {
+		return err
+	}
+	for height < status.Height {
+		headers, err := n.fetchHeaders(peer, height+1, parent)
+		if err != nil {
+			return err
+		}
+		if len(headers) == 0 {
+			return nil
+		}
+		blocks, err := n.fetchBlocks(peer, headers)
+		if err != nil {
+			return err
+		}
+		if err := n.importBlocks(peer, blocks); err != nil {
+			return err
+		}
+		height += len(blocks)
+		parent = blocks[len(blocks)-1].Hash
+	}
+	return nil
+}
+
+// findAncestor returns the height and hash of the last canonical block the
+// node and peer have in common, searching below height, peer's head.
+func (n *Node) findAncestor(peer string, height int) (int, []byte, error) {
+	n.mu.RLock()
+	canonical := n.Blockchain.Blocks
+	n.mu.RUnlock()
+
+	matches := func(height int) (bool, error) {
+		hash, err := n.peerHash(peer, height)
+		return bytes.Equal(hash, canonical[height].Hash), err
+	}
+
+	// The genesis blocks match, and usually so does the node's head.
+	lo, hi := 0, len(canonical)-1
+	if height < hi {
+		hi = height
+	}
+	ok, err := matches(hi)
+	if err != nil {
+		return 0, nil, err
+	}
+	if ok {
+		return hi, canonical[hi].Hash, nil
+	}
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		ok, err := matches(mid)
+		if err != nil {
+			return 0, nil, err
+		}
+		if ok {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return lo, canonical[lo].Hash, nil
+}
+
+func (n *Node) peerHash(peer string, height int) ([]byte, error) {
+	var headers []*blockchain.BlockHeader
+	if err := n.p2p.GetJSON(peer, fmt.Sprintf("/headers?from=%d&count=1", height), &headers); err != nil {
+		return nil, err
+	}
+	if len(headers) == 0 {
+		return nil, fmt.Errorf("peer has no block at height %d", height)
+	}
+	return headers[0].Hash(), nil
+}
+
+// headerChain lets the engine check headers fetched ahead of their blocks.
+// Their state is only known once the blocks are imported, so checks that
+// need it fail with blockchain.ErrMissingState and are left to the import.
+type headerChain struct {
+	blockchain.ChainReader
+	headers map[string]*blockchain.BlockHeader
+	heights map[string]int
+}
+
+func (hc *headerChain) GetHeader(hash []byte) (*blockchain.BlockHeader, int) {
+	key := hex.EncodeToString(hash)
+	if header := hc.headers[key]; header != nil {
+		return header, hc.heights[key]
+	}
+	return hc.ChainReader.GetHeader(hash)
+}
+
+// fetchHeaders fetches the headers of peer's chain from height from on and
+// checks that they extend parent and pass the engine's checks.
+func (n *Node) fetchHeaders(peer string, from int, parent []byte) ([]*blockchain.BlockHeader, error) {
+	var headers []*blockchain.BlockHeader
+	if err := n.p2p.GetJSON(peer, fmt.Sprintf("/headers?from=%d&count=%d", from, maxHeaders), &headers); err != nil {
+		return nil, err
+	}
+
+	hc := &headerChain{ChainReader: n, headers: make(map[string]*blockchain.BlockHeader), heights: make(map[string]int)}
+	for i, header := range headers {
+		if !bytes.Equal(header.PrevBlockHash, parent) {
+			n.p2p.Penalize(peer, p2p.PenaltyInvalidBlock)
+			return nil, errors.New("headers do not link up")
+		}
+		hash := header.Hash()
+		if err := n.engine.VerifyHeader(hc, header); err != nil && !errors.Is(err, blockchain.ErrMissingState) {
+			n.p2p.Penalize(peer, p2p.PenaltyInvalidBlock)
+			return nil, fmt.Errorf("invalid header %x: %w", hash, err)
+		}
+		hc.headers[hex.EncodeToString(hash)] = header
+		hc.heights[hex.EncodeToString(hash)] = from + i
+		parent = hash
+	}
+	return headers, nil
+}
+
+// fetchBlocks downloads the blocks of checked headers, spreading the requests
+// over the peers and falling back to origin, which served the headers.
+func (n *Node) fetchBlocks(origin string, headers []*blockchain.BlockHeader) ([]*blockchain.Block, error) {
+	peers := n.peers()
+	if len(peers) == 0 {
+		peers = []string{origin}
+	}
+
+	blocks := make([]*blockchain.Block, len(headers))
+	errs := make([]error, len(headers))
+	slots := make(chan struct{}, maxBlockFetches)
+	var wg sync.WaitGroup
+	for i, header := range headers {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, hash []byte) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			for _, peer := range []string{peers[i%len(peers)], origin} {
+				if blocks[i], errs[i] = n.fetchBlock(peer, hash); errs[i] == nil {
+					return
+				}
+			}
+		}(i, header.Hash())
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return blocks, nil
+}
+
+func (n *Node) fetchBlock(peer string, hash []byte) (*blockchain.Block, error) {
+	var block blockchain.Block
+	if err := n.p2p.GetJSON(peer, "/blocks/"+hex.EncodeToString(hash), &block); err != nil {
+		return nil, err
+	}
+	if err := block.Validate(); err != nil {
+		n.p2p.Penalize(peer, p2p.PenaltyInvalidBlock)
+		return nil, err
+	}
+	if !bytes.Equal(block.Hash, hash) {
+		n.p2p.Penalize(peer, p2p.PenaltyInvalidBlock)
+		return nil, fmt.Errorf("peer sent block %x for %x", block.Hash, hash)
+	}
+	return &block, nil
+}
+
+// importBlocks inserts blocks fetched for the headers of origin. Blocks that
+// match checked headers but are invalid are origin's fault.
+func (n *Node) importBlocks(origin string, blocks []*blockchain.Block) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, block := range blocks {
+		if err := n.Blockchain.InsertBlock(block); err != nil {
+			if errors.Is(err, blockchain.ErrInvalidBlock) {
+				n.p2p.Penalize(origin, p2p.PenaltyInvalidBlock)
+			}
+			return fmt.Errorf("rejecting block %x: %w", block.Hash, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/duanjr/trustchain/record"
+	"github.com/ethereum/go-ethereum/crypto"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	headerSignature = "X-Node-Signature"
+	headerTimestamp = "X-Node-Timestamp"
+	headerNonce     = "X-Node-Nonce"
+	headerRecipient = "X-Node-Recipient"
+
+	// maxClockSkew is how far from the local clock the timestamp of a
+	// signed message may be.
+	maxClockSkew = 60 * time.Second
+	// MaxMessageSize is the largest message body read from another node.
+	MaxMessageSize = 64 << 20
+	// minReceivedPrune is how many request signatures are kept before
+	// expired ones are dropped.
+	minReceivedPrune = 1024
+
+	handshakePath = "/p2p/handshake"
+)
+
+var (
+	ErrUnsigned     = errors.New("message is not signed")
+	ErrBadSignature = errors.New("invalid message signature")
+	ErrStale        = errors.New("message timestamp out of range")
+	ErrUnregistered = errors.New("node key is not registered")
+	ErrWrongSigner  = errors.New("message signed by another node")
+	ErrRecipient    = errors.New("message signed for another node")
+	ErrReplayed     = errors.New("message already received")
+)
+
+// signingHash is the hash a message signature covers. context is the request
+// the message is, including the node it is for, or the request it answers, so
+// that it cannot be replayed to another endpoint or node. nonce tells apart
+// identical messages sent within a second.
+func signingHash(context, timestamp, nonce string, body []byte) []byte {
+	return crypto.Keccak256([]byte(context), []byte{0}, []byte(timestamp), []byte{0}, []byte(nonce), []byte{0}, body)
+}
+
+// requestContext is the context of a request to the node recipient, which is
+// "" for a handshake with a node not known yet.
+func requestContext(method, uri, recipient string) string {
+	return method + " " + uri + " " + recipient
+}
+
+// responseContext is the context of the response to a request whose
+// signature is requestSignature.
+func responseContext(method, uri, requestSignature string) string {
+	return "response " + method + " " + uri + " " + requestSignature
+}
+
+func (m *Manager) sign(header http.Header, context string, body []byte) {
+	m.mu.Lock()
+	key := m.key
+	m.mu.Unlock()
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	var nonce [8]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		log.Printf("Error signing message: %v", err)
+		return
+	}
+	signature, err := crypto.Sign(signingHash(context, timestamp, hex.EncodeToString(nonce[:]), body), key)
+	if err != nil {
+		log.Printf("Error signing message: %v", err)
+		return
+	}
+	header.Set(headerTimestamp, timestamp)
+	header.Set(headerNonce, hex.EncodeToString(nonce[:]))
+	header.Set(headerSignature, hex.EncodeToString(signature))
+}
+
+// verify returns the node that signed a message, checking that it may be a
+// peer.
+func (m *Manager) verify(header http.Header, context string, body []byte) (string, error) {
+	timestamp, signature := header.Get(headerTimestamp), header.Get(headerSignature)
+	if timestamp == "" || signature == "" {
+		return "", ErrUnsigned
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", ErrStale
+	}
+	if skew := time.Since(time.Unix(unix, 0)); skew > maxClockSkew || skew < -maxClockSkew {
+		return "", ErrStale
+	}
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return "", ErrBadSignature
+	}
+	pub, err := crypto.SigToPub(signingHash(context, timestamp, header.Get(headerNonce), body), sig)
+	if err != nil {
+		return "", ErrBadSignature
+	}
+
+	publicKey := crypto.FromECDSAPub(pub)
+	nodeID := record.SignerAddress(publicKey)
+	if err := m.authorize(nodeID, publicKey); err != nil {
+		return "", err
+	}
+	return nodeID, nil
+}
+
+// authorize checks, in permissioned mode, that publicKey is the key the PKI
+// trie holds for nodeID. Revoked keys are no longer held.
+func (m *Manager) authorize(nodeID string, publicKey []byte) error {
+	m.mu.Lock()
+	permissioned := m.cfg.Permissioned
+	m.mu.Unlock()
+	if permissioned && !bytes.Equal(m.chain.RegisteredKey(nodeID), publicKey) {
+		return ErrUnregistered
+	}
+	return nil
+}
+
+// VerifyRequest returns the node that signed r, whose body is body. A request
+// must be signed for this node, except a handshake, and is only accepted
+// once.
+func (m *Manager) VerifyRequest(r *http.Request, body []byte) (string, error) {
+	recipient := r.Header.Get(headerRecipient)
+	m.mu.Lock()
+	nodeID := m.nodeID
+	m.mu.Unlock()
+	if recipient != nodeID && (recipient != "" || r.URL.Path != handshakePath) {
+		return "", ErrRecipient
+	}
+	signer, err := m.verify(r.Header, requestContext(r.Method, r.URL.RequestURI(), recipient), body)
+	if err != nil {
+		return "", err
+	}
+	if !m.firstSeen(r.Header.Get(headerSignature)) {
+		return "", ErrReplayed
+	}
+	return signer, nil
+}
+
+// firstSeen records a request signature and reports whether it is new.
+// Signatures are kept as long as their timestamps are accepted.
+func (m *Manager) firstSeen(signature string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if _, ok := m.received[signature]; ok {
+		return false
+	}
+	if len(m.received) >= m.receivedPruneAt {
+		for s, at := range m.received {
+			if now.Sub(at) > 2*maxClockSkew {
+				delete(m.received, s)
+			}
+		}
+		m.receivedPruneAt = 2*len(m.received) + minReceivedPrune
+	}
+	m.received[signature] = now
+	return true
+}
+
+// SignResponse signs body, the response to r, into header.
+func (m *Manager) SignResponse(header http.Header, r *http.Request, body []byte) {
+	m.sign(header, responseContext(r.Method, r.URL.RequestURI(), r.Header.Get(headerSignature)), body)
+}
+
+type response struct {
+	status int
+	body   []byte
+	signer string
+}
+
+func (r *response) text() string {
+	return strings.TrimSpace(string(r.body))
+}
+
+// request sends a request signed for the node recipient to peer and returns
+// the response once its signature checks out.
+func (m *Manager) request(method, peer, path, recipient string, body []byte) (*response, error) {
+	req, err := http.NewRequest(method, fmt.Sprintf("%s://%s%s", m.scheme(), peer, path), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set(headerRecipient, recipient)
+	m.sign(req.Header, requestContext(method, path, recipient), body)
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, MaxMessageSize))
+	if err != nil {
+		return nil, err
+	}
+	signer, err := m.verify(resp.Header, responseContext(method, path, req.Header.Get(headerSignature)), data)
+	if err != nil {
+		return nil, fmt.Errorf("response from %s: %w", peer, err)
+	}
+	return &response{status: resp.StatusCode, body: data, signer: signer}, nil
+}
+
+// peerRequest is request for a peer that identified itself in a handshake,
+// whose responses must be signed by the same node.
+func (m *Manager) peerRequest(method, peer, path string, body []byte) (*response, error) {
+	m.mu.Lock()
+	var nodeID string
+	if p := m.peers[peer]; p != nil {
+		nodeID = p.NodeID
+	}
+	m.mu.Unlock()
+	if nodeID == "" {
+		return nil, fmt.Errorf("request to %s: %w", peer, ErrWrongSigner)
+	}
+	resp, err := m.request(method, peer, path, nodeID, body)
+	if err != nil {
+		return nil, err
+	}
+	if nodeID != resp.signer {
+		return nil, fmt.Errorf("response from %s: %w", peer, ErrWrongSigner)
+	}
+	return resp, nil
+}
+
+// GetJSON fetches path from peer into v.
+func (m *Manager) GetJSON(peer, path string, v interface{}) error {
+	resp, err := m.peerRequest(http.MethodGet, peer, path, nil)
+	if err != nil {
+		return err
+	}
+	if resp.status != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", path, resp.text())
+	}
+	return json.Unmarshal(resp.body, v)
+}
+
+// Send posts a JSON message to path on peer.
+func (m *Manager) Send(peer, path string, data []byte) error {
+	resp, err := m.peerRequest(http.MethodPost, peer, path, data)
+	if err != nil {
+		return err
+	}
+	if resp.status >= http.StatusMultipleChoices {
+		return fmt.Errorf("POST %s: %s", path, resp.text())
+	}
+	return nil
+}
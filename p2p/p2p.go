@@ -0,0 +1,605 @@
+package p2p
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/duanjr/trustchain/record"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ProtocolVersion is the version of the node-to-node endpoints. Nodes only
+// peer with nodes of the same version.
+const ProtocolVersion = 1
+
+const (
+	// banScore is the score at which a peer is banned for banDuration.
+	banScore    = -100
+	banDuration = time.Hour
+	// maxFailures is how many handshakes in a row a peer may fail before it
+	// is forgotten. Bootstrap peers are never forgotten.
+	maxFailures = 5
+	// maxExchangedPeers is how many addresses are taken from the peer list
+	// of another node.
+	maxExchangedPeers = 32
+
+	// Penalties lower the score of a peer that sent something invalid. A
+	// peer is banned for repeated invalid blocks, not for one.
+	PenaltyInvalidRecord = 10
+	PenaltyInvalidBlock  = -banScore / 2
+)
+
+var (
+	ErrVersion      = errors.New("incompatible protocol version")
+	ErrChainID      = errors.New("different chain id")
+	ErrGenesis      = errors.New("different genesis block")
+	ErrSelf         = errors.New("connection to self")
+	ErrBanned       = errors.New("peer is banned")
+	ErrTooManyPeers = errors.New("too many peers")
+)
+
+var (
+	nodeKeyKey = []byte("NodeKey")
+	peersKey   = []byte("Peers")
+)
+
+// Handshake identifies a node to the nodes it connects to.
+type Handshake struct {
+	Version int    `json:"version"`
+	ChainID string `json:"chainId"`
+	Genesis string `json:"genesis"`
+	// NodeID is the address of the node's key, which signs its messages.
+	NodeID string `json:"nodeId"`
+	// Address is the host:port the node is reached at, or "" if it accepts
+	// no connections.
+	Address string `json:"address"`
+}
+
+type Config struct {
+	ChainID string
+	// NodeKey signs the node's messages. If nil, a key generated on first
+	// start and kept in the database is used.
+	NodeKey *ecdsa.PrivateKey
+	// Permissioned only admits peers whose node key is registered in the
+	// PKI trie.
+	Permissioned bool
+	// Address is the host:port peers reach this node at, or "" if they
+	// cannot.
+	Address   string
+	Bootstrap []string
+	MaxPeers  int
+	// PingInterval is how often peers are pinged, by repeating the
+	// handshake, and new ones looked for.
+	PingInterval time.Duration
+	// TLS connects to peers over mutual TLS, in which both ends present the
+	// identity certificate of their node key. Peers must agree on it.
+	TLS bool
+}
+
+var DefaultConfig = Config{
+	ChainID:      "trustchain",
+	MaxPeers:     25,
+	PingInterval: 30 * time.Second,
+}
+
+type Peer struct {
+	Address     string `json:"address"`
+	NodeID      string `json:"nodeId"`
+	Score       int    `json:"score"`
+	LastSeen    int64  `json:"lastSeen"`
+	BannedUntil int64  `json:"bannedUntil,omitempty"`
+	Bootstrap   bool   `json:"bootstrap,omitempty"`
+	failures    int
+	active      bool
+}
+
+func (p *Peer) banned(now time.Time) bool {
+	return p.BannedUntil > now.Unix()
+}
+
+// Chain is what the manager reads of the node's chain.
+type Chain interface {
+	// ChainStatus returns the genesis hash and height of the chain.
+	ChainStatus() (genesis string, height int)
+	// RegisteredKey returns the public key the PKI trie holds for address,
+	// or nil.
+	RegisteredKey(address string) []byte
+}
+
+// Manager keeps the peers of a node: the ones it knows of, which of them
+// answer, and how well they behave. Known peers are stored in the node's
+// database and outlive restarts. It also holds the node key, and every
+// message between nodes goes through it to be signed and verified.
+type Manager struct {
+	mu     sync.Mutex
+	cfg    Config
+	key    *ecdsa.PrivateKey
+	cert   *tls.Certificate
+	nodeID string
+	chain  Chain
+	peers  map[string]*Peer
+	db     ethdb.KeyValueStore
+	client *http.Client
+	// received holds the signatures of recent requests, to refuse replays.
+	received        map[string]time.Time
+	receivedPruneAt int
+	dropped         func(address string)
+}
+
+func New(db ethdb.KeyValueStore, chain Chain) (*Manager, error) {
+	key, err := loadNodeKey(db)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manager{
+		cfg:             DefaultConfig,
+		key:             key,
+		nodeID:          record.SignerAddress(crypto.FromECDSAPub(&key.PublicKey)),
+		chain:           chain,
+		peers:           make(map[string]*Peer),
+		db:              db,
+		received:        make(map[string]time.Time),
+		receivedPruneAt: minReceivedPrune,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = m.clientTLSConfig()
+	m.client = &http.Client{Timeout: 15 * time.Second, Transport: transport}
+	if data, err := db.Get(peersKey); err == nil {
+		var peers []*Peer
+		if err := json.Unmarshal(data, &peers); err != nil {
+			return nil, err
+		}
+		for _, p := range peers {
+			m.peers[p.Address] = p
+		}
+	}
+	return m, nil
+}
+
+// loadNodeKey returns the node key kept in db, generating it on first use.
+func loadNodeKey(db ethdb.KeyValueStore) (*ecdsa.PrivateKey, error) {
+	if data, err := db.Get(nodeKeyKey); err == nil {
+		return crypto.ToECDSA(data)
+	}
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Put(nodeKeyKey, crypto.FromECDSA(key)); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// SetConfig replaces the configuration and adds its bootstrap peers.
+func (m *Manager) SetConfig(cfg Config) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cfg = cfg
+	if cfg.NodeKey != nil {
+		m.key = cfg.NodeKey
+		m.cert = nil
+		m.nodeID = record.SignerAddress(crypto.FromECDSAPub(&cfg.NodeKey.PublicKey))
+	}
+	for _, address := range cfg.Bootstrap {
+		p := m.peers[address]
+		if p == nil {
+			p = &Peer{Address: address}
+			m.peers[address] = p
+		}
+		p.Bootstrap = true
+	}
+}
+
+// NodeID returns the address of the node key.
+func (m *Manager) NodeID() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.nodeID
+}
+
+func (m *Manager) PingInterval() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.cfg.PingInterval
+}
+
+// Handshake returns the handshake of this node.
+func (m *Manager) Handshake() *Handshake {
+	genesis, _ := m.chain.ChainStatus()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return &Handshake{
+		Version: ProtocolVersion,
+		ChainID: m.cfg.ChainID,
+		Genesis: genesis,
+		NodeID:  m.nodeID,
+		Address: m.cfg.Address,
+	}
+}
+
+// check tells whether the node h identifies, whose messages signer signed,
+// can be a peer. Nodes of another genesis block are on another network.
+func (m *Manager) check(h *Handshake, signer string) error {
+	genesis, _ := m.chain.ChainStatus()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case h.NodeID != signer:
+		return ErrWrongSigner
+	case h.Version != ProtocolVersion:
+		return ErrVersion
+	case h.ChainID != m.cfg.ChainID:
+		return ErrChainID
+	case h.NodeID == m.nodeID:
+		return ErrSelf
+	case m.bannedNode(h.NodeID):
+		return ErrBanned
+	case h.Genesis != genesis:
+		return ErrGenesis
+	}
+	return nil
+}
+
+// Accept checks the handshake of a node connecting to this one, signed by
+// signer, and, if it can be reached at its address, makes it an active peer.
+// It reports whether the peer was not active before.
+func (m *Manager) Accept(h *Handshake, signer string) (bool, error) {
+	if err := m.check(h, signer); err != nil {
+		return false, err
+	}
+	if h.Address == "" {
+		return false, nil
+	}
+	if err := validateAddress(h.Address); err != nil {
+		return false, err
+	}
+	m.mu.Lock()
+	p := m.peers[h.Address]
+	known := p != nil && p.active && p.NodeID == h.NodeID
+	full := !m.room(p)
+	m.mu.Unlock()
+	if full {
+		return false, ErrTooManyPeers
+	}
+	if !known {
+		if err := m.reach(h.Address, h.NodeID); err != nil {
+			return false, err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p = m.peers[h.Address]
+	if p != nil && p.banned(time.Now()) {
+		return false, ErrBanned
+	}
+	if !m.room(p) {
+		return false, ErrTooManyPeers
+	}
+	if p == nil {
+		p = &Peer{Address: h.Address}
+		m.peers[h.Address] = p
+	}
+	added := !p.active
+	m.succeeded(p, h.NodeID)
+	return added, nil
+}
+
+// Connect performs the handshake with the node at address and makes it an
+// active peer if it can be one.
+func (m *Manager) Connect(address string) error {
+	if err := validateAddress(address); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	if p := m.peers[address]; p != nil && p.banned(time.Now()) {
+		m.mu.Unlock()
+		return ErrBanned
+	}
+	m.mu.Unlock()
+
+	h, signer, err := m.dial(address)
+	if err == nil {
+		err = m.check(h, signer)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := m.peers[address]
+	if err != nil {
+		if p != nil {
+			m.failed(p)
+		}
+		return err
+	}
+	if !m.room(p) {
+		return ErrTooManyPeers
+	}
+	if p == nil {
+		p = &Peer{Address: address}
+		m.peers[address] = p
+	}
+	m.succeeded(p, h.NodeID)
+	return nil
+}
+
+// reach checks that the node nodeID answers at address, so that a node cannot
+// have this one send its messages to an address that is not its own. It asks
+// for the node's peers rather than repeating the handshake, which would make
+// the node dial back in turn.
+func (m *Manager) reach(address, nodeID string) error {
+	resp, err := m.request(http.MethodGet, address, "/peers", nodeID, nil)
+	if err != nil {
+		return err
+	}
+	if resp.signer != nodeID {
+		return fmt.Errorf("node at %s: %w", address, ErrWrongSigner)
+	}
+	return nil
+}
+
+// dial sends this node's handshake to address and returns the answer and
+// the node that signed it.
+func (m *Manager) dial(address string) (*Handshake, string, error) {
+	data, err := json.Marshal(m.Handshake())
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := m.request(http.MethodPost, address, handshakePath, "", data)
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.status != http.StatusOK {
+		return nil, "", fmt.Errorf("handshake refused: %s", resp.text())
+	}
+
+	var h Handshake
+	if err := json.Unmarshal(resp.body, &h); err != nil {
+		return nil, "", err
+	}
+	return &h, resp.signer, nil
+}
+
+// succeeded records an answer from p. Peers recover from small penalties
+// while they keep answering.
+func (m *Manager) succeeded(p *Peer, nodeID string) {
+	p.NodeID = nodeID
+	p.active = true
+	p.failures = 0
+	p.LastSeen = time.Now().Unix()
+	if p.Score < 0 {
+		p.Score++
+	}
+}
+
+// OnDrop sets f to be called with the address of a peer when it stops being
+// active, because it failed a handshake or was banned. f is called with the
+// manager locked and must not call into it.
+func (m *Manager) OnDrop(f func(address string)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dropped = f
+}
+
+// deactivate marks p inactive. The caller must hold m.mu.
+func (m *Manager) deactivate(p *Peer) {
+	p.active = false
+	if m.dropped != nil {
+		m.dropped(p.Address)
+	}
+}
+
+func (m *Manager) failed(p *Peer) {
+	m.deactivate(p)
+	p.failures++
+	if p.failures >= maxFailures && !p.Bootstrap {
+		delete(m.peers, p.Address)
+	}
+}
+
+// Penalize lowers the score of the peer at address, banning it once the
+// score reaches banScore.
+func (m *Manager) Penalize(address string, penalty int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p := m.peers[address]; p != nil {
+		m.penalize(p, penalty)
+	}
+}
+
+// PenalizeNode lowers the score of the peer with the given node ID.
+func (m *Manager) PenalizeNode(nodeID string, penalty int) {
+	if nodeID == "" {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, p := range m.peers {
+		if p.NodeID == nodeID {
+			m.penalize(p, penalty)
+		}
+	}
+}
+
+// bannedNode reports whether a peer with nodeID is banned. The caller must
+// hold m.mu.
+func (m *Manager) bannedNode(nodeID string) bool {
+	now := time.Now()
+	for _, p := range m.peers {
+		if p.NodeID == nodeID && p.banned(now) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Manager) penalize(p *Peer, penalty int) {
+	p.Score -= penalty
+	if p.Score > banScore {
+		return
+	}
+	log.Printf("Banning peer %s for %s", p.Address, banDuration)
+	p.Score = 0
+	m.deactivate(p)
+	p.BannedUntil = time.Now().Add(banDuration).Unix()
+	m.save()
+}
+
+// Active returns the addresses of the peers that answered the last
+// handshake.
+func (m *Manager) Active() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var active []string
+	for address, p := range m.peers {
+		if p.active {
+			active = append(active, address)
+		}
+	}
+	sort.Strings(active)
+	return active
+}
+
+// room reports whether p, which may be nil for a new peer, can be active
+// without exceeding MaxPeers. The caller must hold m.mu.
+func (m *Manager) room(p *Peer) bool {
+	return (p != nil && p.active) || m.activeCount() < m.cfg.MaxPeers
+}
+
+func (m *Manager) activeCount() int {
+	count := 0
+	for _, p := range m.peers {
+		if p.active {
+			count++
+		}
+	}
+	return count
+}
+
+// Peers returns every known peer.
+func (m *Manager) Peers() []Peer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	peers := make([]Peer, 0, len(m.peers))
+	for _, p := range m.peers {
+		peers = append(peers, *p)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Address < peers[j].Address })
+	return peers
+}
+
+// Maintain pings every known peer that is not banned and, while fewer than
+// MaxPeers are active, connects to the peers of active peers, no more at once
+// than there is room for. It returns the peers that became active.
+func (m *Manager) Maintain() []string {
+	before := make(map[string]bool)
+	for _, address := range m.Active() {
+		before[address] = true
+	}
+
+	m.mu.Lock()
+	var addresses []string
+	now := time.Now()
+	for address, p := range m.peers {
+		if !p.banned(now) {
+			addresses = append(addresses, address)
+		}
+	}
+	m.mu.Unlock()
+	m.connectAll(addresses)
+
+	for _, peer := range m.Active() {
+		room := m.maxPeers() - len(m.Active())
+		if room <= 0 {
+			break
+		}
+		var exchanged []string
+		if err := m.GetJSON(peer, "/peers", &exchanged); err != nil {
+			continue
+		}
+		if len(exchanged) > maxExchangedPeers {
+			exchanged = exchanged[:maxExchangedPeers]
+		}
+		unknown := m.unknown(exchanged)
+		if len(unknown) > room {
+			unknown = unknown[:room]
+		}
+		m.connectAll(unknown)
+	}
+	m.mu.Lock()
+	m.save()
+	m.mu.Unlock()
+
+	var added []string
+	for _, address := range m.Active() {
+		if !before[address] {
+			added = append(added, address)
+		}
+	}
+	return added
+}
+
+func (m *Manager) connectAll(addresses []string) {
+	var wg sync.WaitGroup
+	for _, address := range addresses {
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			m.Connect(address)
+		}(address)
+	}
+	wg.Wait()
+}
+
+// unknown returns the addresses that are not known peers or this node.
+func (m *Manager) unknown(addresses []string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var unknown []string
+	for _, address := range addresses {
+		if m.peers[address] == nil && address != m.cfg.Address {
+			unknown = append(unknown, address)
+		}
+	}
+	return unknown
+}
+
+func (m *Manager) maxPeers() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.cfg.MaxPeers
+}
+
+// save stores the known peers. The caller must hold m.mu.
+func (m *Manager) save() {
+	peers := make([]*Peer, 0, len(m.peers))
+	for _, p := range m.peers {
+		peers = append(peers, p)
+	}
+	data, err := json.Marshal(peers)
+	if err == nil {
+		err = m.db.Put(peersKey, data)
+	}
+	if err != nil {
+		log.Printf("Error saving peers: %v", err)
+	}
+}
+
+func validateAddress(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || host == "" || port == "" {
+		return fmt.Errorf("invalid peer address %q", address)
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"github.com/duanjr/trustchain/record"
+	"github.com/ethereum/go-ethereum/crypto"
+	"math/big"
+	"time"
+)
+
+// The keys of the PKI are secp256k1 keys, which X.509 does not support. An
+// identity certificate is instead a self-signed certificate for a P-256 key
+// that carries an extension in which the identity key signs the certificate
+// key.
+var identityExtension = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+
+const identityPrefix = "trustchain tls identity:"
+
+var (
+	ErrNoCertificate        = errors.New("no certificate presented")
+	ErrNoIdentity           = errors.New("certificate carries no identity")
+	ErrCertificateExpired   = errors.New("certificate expired or not yet valid")
+	ErrBadIdentitySignature = errors.New("invalid identity signature in certificate")
+)
+
+type identity struct {
+	PublicKey []byte
+	Signature []byte
+}
+
+// IdentityCertificate returns a new identity certificate for key, which
+// proves to the other end of a TLS connection that it talks to the holder of
+// key.
+func IdentityCertificate(key *ecdsa.PrivateKey) (*tls.Certificate, error) {
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	spki, err := x509.MarshalPKIXPublicKey(&certKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := crypto.Sign(crypto.Keccak256([]byte(identityPrefix), spki), key)
+	if err != nil {
+		return nil, err
+	}
+	publicKey := crypto.FromECDSAPub(&key.PublicKey)
+	extension, err := asn1.Marshal(identity{PublicKey: publicKey, Signature: signature})
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:    serial,
+		Subject:         pkix.Name{CommonName: record.SignerAddress(publicKey)},
+		NotBefore:       now.Add(-time.Hour),
+		NotAfter:        now.Add(365 * 24 * time.Hour),
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		ExtraExtensions: []pkix.Extension{{Id: identityExtension, Value: extension}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &certKey.PublicKey, certKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: certKey, Leaf: leaf}, nil
+}
+
+// CertificateIdentity returns the identity key an identity certificate was
+// made for, in the uncompressed form the PKI trie holds. The TLS handshake
+// proves that the other end holds the certificate key, which the identity
+// key signed.
+func CertificateIdentity(rawCerts [][]byte) ([]byte, error) {
+	if len(rawCerts) == 0 {
+		return nil, ErrNoCertificate
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return nil, err
+	}
+	if now := time.Now(); now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return nil, ErrCertificateExpired
+	}
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(identityExtension) {
+			continue
+		}
+		var id identity
+		if _, err := asn1.Unmarshal(ext.Value, &id); err != nil {
+			return nil, ErrNoIdentity
+		}
+		pub, err := crypto.SigToPub(crypto.Keccak256([]byte(identityPrefix), cert.RawSubjectPublicKeyInfo), id.Signature)
+		if err != nil {
+			return nil, ErrBadIdentitySignature
+		}
+		if publicKey := crypto.FromECDSAPub(pub); bytes.Equal(publicKey, id.PublicKey) {
+			return publicKey, nil
+		}
+		return nil, ErrBadIdentitySignature
+	}
+	return nil, ErrNoIdentity
+}
+
+// Certificate returns the identity certificate of the node key.
+func (m *Manager) Certificate() (*tls.Certificate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cert == nil {
+		cert, err := IdentityCertificate(m.key)
+		if err != nil {
+			return nil, err
+		}
+		m.cert = cert
+	}
+	return m.cert, nil
+}
+
+// verifyCertificate checks the identity certificate of a peer like the
+// signature of its messages.
+func (m *Manager) verifyCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	publicKey, err := CertificateIdentity(rawCerts)
+	if err != nil {
+		return err
+	}
+	return m.authorize(record.SignerAddress(publicKey), publicKey)
+}
+
+// TLSConfig returns the configuration of the TLS listener for the peer API,
+// or nil if peers connect without TLS. Both ends of a connection present the
+// identity certificate of their node key.
+func (m *Manager) TLSConfig() *tls.Config {
+	m.mu.Lock()
+	enabled := m.cfg.TLS
+	m.mu.Unlock()
+	if !enabled {
+		return nil
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return m.Certificate()
+		},
+		ClientAuth:            tls.RequireAnyClientCert,
+		VerifyPeerCertificate: m.verifyCertificate,
+	}
+}
+
+// clientTLSConfig is the configuration of connections to peers. Identity
+// certificates are self-signed, so the usual verification against CAs and
+// host names is replaced with verifyCertificate.
+func (m *Manager) clientTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return m.Certificate()
+		},
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: m.verifyCertificate,
+	}
+}
+
+func (m *Manager) scheme() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cfg.TLS {
+		return "https"
+	}
+	return "http"
+}
@@ -1,19 +1,27 @@
 package pki
 
 import (
-	"bytes"
 	"encoding/base64"
 	"encoding/hex"
 	"errors"
-	"fmt"
+	"github.com/duanjr/trustchain/blockchain"
+	"github.com/duanjr/trustchain/record"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
-	"github.com/ethereum/go-ethereum/trie"
+	"time"
 )
 
-var Trie *trie.Trie
+// Registry verifies the signatures of PKI requests and turns them into
+// records, and answers queries from a chain's state. Whether a request fits
+// the state is checked when the node applies its record.
+type Registry struct {
+	state func() *blockchain.State
+}
 
-func Initialize(t *trie.Trie) {
-	Trie = t
+// NewRegistry returns a registry of the state state returns, which is asked
+// for on every request since the chain replaces it as blocks are added.
+func NewRegistry(state func() *blockchain.State) *Registry {
+	return &Registry{state: state}
 }
 
 type RegisterRequest struct {
@@ -22,42 +30,39 @@ type RegisterRequest struct {
 	Address   string `json:"address"`
 }
 
-func Register(publicKey, signature, address string) (bool, string) {
+func (r *Registry) Register(publicKey, signature, address string) (*record.Record, error) {
 	if publicKey == "" || signature == "" || address == "" {
-		return false, "Missing values"
+		return nil, errors.New("Missing values")
 	}
 
 	msg := "register" + address
 	hashedMessage := crypto.Keccak256Hash([]byte(msg))
 	sig, err := base64.StdEncoding.DecodeString(signature)
 	if err != nil {
-		return false, "Invalid signature format"
+		return nil, errors.New("Invalid signature format")
 	}
 
 	recoveredPubkey, err := crypto.SigToPub(hashedMessage.Bytes(), sig)
 	if err != nil {
-		return false, "Unable to recover public key from signature"
+		return nil, errors.New("Unable to recover public key from signature")
 	}
 
 	recoveredAddress := crypto.PubkeyToAddress(*recoveredPubkey)
 	pubkeyBytes, err := hex.DecodeString(publicKey)
 	if err != nil {
-		return false, "Invalid public key format"
+		return nil, errors.New("Invalid public key format")
 	}
 
 	pub, err := crypto.UnmarshalPubkey(pubkeyBytes)
+	if err != nil {
+		return nil, errors.New("Invalid public key format")
+	}
 	computedAddress := crypto.PubkeyToAddress(*pub)
 
 	if recoveredAddress == computedAddress {
-		if val, _ := Trie.TryGet([]byte(address)); val != nil {
-			return false, "Address registered"
-		}
-
-		record := fmt.Sprintf("PKI:Register:PublicKey:%s:Address:%s", publicKey, address)
-		Trie.Update([]byte(address), pubkeyBytes)
-		return true, record
+		return record.NewPKIRegister(address, pubkeyBytes, sig, uint64(time.Now().Unix())), nil
 	} else {
-		return false, "Wrong argument"
+		return nil, errors.New("Wrong argument")
 	}
 }
 
@@ -69,77 +74,86 @@ type UpdateRequest struct {
 	Address    string `json:"address"`
 }
 
-func Update(publicKey1, signature1, publicKey2, signature2, address string) (bool, string) {
+func (r *Registry) Update(publicKey1, signature1, publicKey2, signature2, address string) (*record.Record, error) {
 	if publicKey1 == "" || signature1 == "" || publicKey2 == "" || signature2 == "" || address == "" {
-		return false, "Missing values"
+		return nil, errors.New("Missing values")
 	}
 
 	msg1 := publicKey2
 	hashedMessage1 := crypto.Keccak256Hash([]byte(msg1))
 	sig1, err := base64.StdEncoding.DecodeString(signature1)
 	if err != nil {
-		return false, "Invalid signature1 format"
+		return nil, errors.New("Invalid signature1 format")
 	}
 
 	recoveredPubkey1, err := crypto.SigToPub(hashedMessage1.Bytes(), sig1)
 	if err != nil {
-		return false, "Unable to recover public key from signature1"
+		return nil, errors.New("Unable to recover public key from signature1")
 	}
 
 	recoveredAddress1 := crypto.PubkeyToAddress(*recoveredPubkey1)
 	pubkeyBytes1, err := hex.DecodeString(publicKey1)
 	if err != nil {
-		return false, "Invalid publicKey1 format"
+		return nil, errors.New("Invalid publicKey1 format")
 	}
 
 	pub1, err := crypto.UnmarshalPubkey(pubkeyBytes1)
+	if err != nil {
+		return nil, errors.New("Invalid publicKey1 format")
+	}
 	computedAddress1 := crypto.PubkeyToAddress(*pub1)
 
 	msg2 := "register" + address
 	hashedMessage2 := crypto.Keccak256Hash([]byte(msg2))
 	sig2, err := base64.StdEncoding.DecodeString(signature2)
 	if err != nil {
-		return false, "Invalid signature2 format"
+		return nil, errors.New("Invalid signature2 format")
 	}
 
 	recoveredPubkey2, err := crypto.SigToPub(hashedMessage2.Bytes(), sig2)
 	if err != nil {
-		return false, "Unable to recover public key from signature2"
+		return nil, errors.New("Unable to recover public key from signature2")
 	}
 
 	recoveredAddress2 := crypto.PubkeyToAddress(*recoveredPubkey2)
 	pubkeyBytes2, err := hex.DecodeString(publicKey2)
 	if err != nil {
-		return false, "Invalid publicKey2 format"
+		return nil, errors.New("Invalid publicKey2 format")
 	}
 
 	pub2, err := crypto.UnmarshalPubkey(pubkeyBytes2)
+	if err != nil {
+		return nil, errors.New("Invalid publicKey2 format")
+	}
 	computedAddress2 := crypto.PubkeyToAddress(*pub2)
 
 	if computedAddress1 == recoveredAddress1 && computedAddress2 == recoveredAddress2 {
-		oldPubKey, _ := Trie.TryGet([]byte(address))
-		if !bytes.Equal(oldPubKey, pubkeyBytes1) {
-			return false, "Wrong old public key"
-		}
-
-		record := fmt.Sprintf("PKI:Update:PublicKey:%s:Address:%s", publicKey2, address)
-		Trie.Update([]byte(address), pubkeyBytes2)
-		return true, record
+		return record.NewPKIUpdate(address, pubkeyBytes1, sig1, publicKey2, sig2, uint64(time.Now().Unix())), nil
 	} else {
-		return false, "Wrong signatures"
+		return nil, errors.New("Wrong signatures")
 	}
 }
 
 type QueryRequest struct {
 	Address string `json:"address"`
+	Proof   bool   `json:"proof"`
+}
+
+type QueryProofResponse struct {
+	Address   string                 `json:"address"`
+	PublicKey string                 `json:"publicKey"`
+	Proof     *blockchain.StateProof `json:"proof"`
 }
 
-func Query(address string) (string, error) {
+// Query looks address up in a copy of the PKI trie, so it may run
+// concurrently with other readers.
+func (r *Registry) Query(address string) (string, error) {
 	if address == "" {
 		return "", errors.New("missing address")
 	}
 
-	pubkeyBytes, err := Trie.TryGet([]byte(address))
+	pkiTrie, _, _ := r.state().ReadTries()
+	pubkeyBytes, err := pkiTrie.TryGet([]byte(address))
 	if err != nil {
 		return "", errors.New("no such identity")
 	}
@@ -147,48 +161,60 @@ func Query(address string) (string, error) {
 	return hex.EncodeToString(pubkeyBytes), nil
 }
 
+// VerifyQueryProof checks a proof-carrying query answer without access to
+// the node's state. root must be the PkiRootHash of a block the caller trusts.
+func VerifyQueryProof(resp *QueryProofResponse, root common.Hash) error {
+	if resp.Proof == nil || resp.Proof.Root != root {
+		return errors.New("proof is not anchored to the expected root")
+	}
+	value, err := blockchain.VerifyStateProof([]byte(resp.Address), resp.Proof)
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(value) != resp.PublicKey {
+		return errors.New("public key does not match proof")
+	}
+	return nil
+}
+
 type RevokeRequest struct {
 	PublicKey string `json:"publicKey"`
 	Signature string `json:"signature"`
 	Address   string `json:"address"`
 }
 
-func Revoke(publicKey, signature, address string) (bool, string) {
+func (r *Registry) Revoke(publicKey, signature, address string) (*record.Record, error) {
 	if publicKey == "" || signature == "" || address == "" {
-		return false, "Missing values"
+		return nil, errors.New("Missing values")
 	}
 
 	msg := "revoke" + address
 	hashedMessage := crypto.Keccak256Hash([]byte(msg))
 	sig, err := base64.StdEncoding.DecodeString(signature)
 	if err != nil {
-		return false, "Invalid signature format"
+		return nil, errors.New("Invalid signature format")
 	}
 
 	recoveredPubkey, err := crypto.SigToPub(hashedMessage.Bytes(), sig)
 	if err != nil {
-		return false, "Unable to recover public key from signature"
+		return nil, errors.New("Unable to recover public key from signature")
 	}
 
 	recoveredAddress := crypto.PubkeyToAddress(*recoveredPubkey)
 	pubkeyBytes, err := hex.DecodeString(publicKey)
 	if err != nil {
-		return false, "Invalid public key format"
+		return nil, errors.New("Invalid public key format")
 	}
 
 	pub, err := crypto.UnmarshalPubkey(pubkeyBytes)
+	if err != nil {
+		return nil, errors.New("Invalid public key format")
+	}
 	computedAddress := crypto.PubkeyToAddress(*pub)
 
 	if recoveredAddress == computedAddress {
-		storedPublicKey, err := Query(address)
-		if err != nil || storedPublicKey != publicKey {
-			return false, "Wrong public key to revoke"
-		}
-
-		record := fmt.Sprintf("PKI:Revoke:PublicKey:%s:Address:%s", publicKey, address)
-		Trie.Delete([]byte(address))
-		return true, record
+		return record.NewPKIRevoke(address, pubkeyBytes, sig, uint64(time.Now().Unix())), nil
 	} else {
-		return false, "Wrong argument"
+		return nil, errors.New("Wrong argument")
 	}
 }
@@ -0,0 +1,288 @@
+package record
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"log"
+	"strconv"
+	"strings"
+)
+
+type Kind uint8
+
+const (
+	KindData Kind = iota
+	KindPKIRegister
+	KindPKIUpdate
+	KindPKIRevoke
+	KindTrustSubmit
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindData:
+		return "Data"
+	case KindPKIRegister:
+		return "PKI:Register"
+	case KindPKIUpdate:
+		return "PKI:Update"
+	case KindPKIRevoke:
+		return "PKI:Revoke"
+	case KindTrustSubmit:
+		return "Trust:Submit"
+	}
+	return "Unknown(" + strconv.Itoa(int(k)) + ")"
+}
+
+// Record is a signed state transition as stored in blocks. Payload holds the
+// RLP encoding of the kind-specific payload and Signer the uncompressed
+// secp256k1 public key whose Signature authorizes it.
+type Record struct {
+	Kind      Kind
+	Payload   []byte
+	Signer    []byte
+	Signature []byte
+	Nonce     uint64
+	Timestamp uint64
+}
+
+type PKIRegister struct {
+	Address string
+}
+
+// PKIUpdate is signed by the old key. NewSignature proves control of the new
+// key over the same message as a registration.
+type PKIUpdate struct {
+	Address      string
+	NewPublicKey string
+	NewSignature []byte
+}
+
+type PKIRevoke struct {
+	Address string
+}
+
+// TrustSubmit carries the trust value in the textual form it was submitted
+// in, since floating point values have no RLP encoding.
+type TrustSubmit struct {
+	AddressI   string
+	AddressJ   string
+	TrustValue string
+}
+
+func newRecord(kind Kind, payload interface{}, signer, signature []byte, timestamp uint64) *Record {
+	return &Record{Kind: kind, Payload: mustEncode(payload), Signer: signer, Signature: signature, Timestamp: timestamp}
+}
+
+func NewData(data []byte, nonce uint64, timestamp uint64) *Record {
+	return &Record{Kind: KindData, Payload: data, Nonce: nonce, Timestamp: timestamp}
+}
+
+func NewPKIRegister(address string, publicKey, signature []byte, timestamp uint64) *Record {
+	return newRecord(KindPKIRegister, &PKIRegister{address}, publicKey, signature, timestamp)
+}
+
+func NewPKIUpdate(address string, oldPublicKey, signature []byte, newPublicKey string, newSignature []byte, timestamp uint64) *Record {
+	return newRecord(KindPKIUpdate, &PKIUpdate{address, newPublicKey, newSignature}, oldPublicKey, signature, timestamp)
+}
+
+func NewPKIRevoke(address string, publicKey, signature []byte, timestamp uint64) *Record {
+	return newRecord(KindPKIRevoke, &PKIRevoke{address}, publicKey, signature, timestamp)
+}
+
+func NewTrustSubmit(addressI, addressJ string, trustValue float64, signer, signature []byte, timestamp uint64) *Record {
+	payload := &TrustSubmit{addressI, addressJ, strconv.FormatFloat(trustValue, 'f', -1, 64)}
+	return newRecord(KindTrustSubmit, payload, signer, signature, timestamp)
+}
+
+func Decode(data []byte) (*Record, error) {
+	r := new(Record)
+	if err := rlp.DecodeBytes(data, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Record) Bytes() []byte {
+	return mustEncode(r)
+}
+
+// Hash identifies the record by what its signature covers, so the fields
+// anyone can change without the signer's key, and the signature itself,
+// cannot make a new record out of a signed one.
+func (r *Record) Hash() common.Hash {
+	signed := *r
+	signed.Signature = nil
+	switch r.Kind {
+	case KindPKIRegister, KindPKIUpdate, KindPKIRevoke:
+		signed.Nonce, signed.Timestamp = 0, 0
+	case KindTrustSubmit:
+		signed.Nonce = 0
+	}
+	return crypto.Keccak256Hash(signed.Bytes())
+}
+
+func (r *Record) PKIRegister() (*PKIRegister, error) {
+	p := new(PKIRegister)
+	return p, r.decodePayload(KindPKIRegister, p)
+}
+
+func (r *Record) PKIUpdate() (*PKIUpdate, error) {
+	p := new(PKIUpdate)
+	return p, r.decodePayload(KindPKIUpdate, p)
+}
+
+func (r *Record) PKIRevoke() (*PKIRevoke, error) {
+	p := new(PKIRevoke)
+	return p, r.decodePayload(KindPKIRevoke, p)
+}
+
+func (r *Record) TrustSubmit() (*TrustSubmit, error) {
+	p := new(TrustSubmit)
+	return p, r.decodePayload(KindTrustSubmit, p)
+}
+
+func (r *Record) decodePayload(kind Kind, payload interface{}) error {
+	if r.Kind != kind {
+		return fmt.Errorf("record is %v, not %v", r.Kind, kind)
+	}
+	return rlp.DecodeBytes(r.Payload, payload)
+}
+
+// SigningHash returns the hash Signature must cover. PKI and trust records
+// keep the messages their request types have always been signed over, so
+// existing clients can produce them; data records sign the whole envelope.
+func (r *Record) SigningHash() (common.Hash, error) {
+	var msg string
+	switch r.Kind {
+	case KindData:
+		data, err := rlp.EncodeToBytes([]interface{}{r.Kind, r.Payload, r.Nonce, r.Timestamp})
+		if err != nil {
+			return common.Hash{}, err
+		}
+		return crypto.Keccak256Hash(data), nil
+	case KindPKIRegister:
+		p, err := r.PKIRegister()
+		if err != nil {
+			return common.Hash{}, err
+		}
+		msg = "register" + p.Address
+	case KindPKIUpdate:
+		p, err := r.PKIUpdate()
+		if err != nil {
+			return common.Hash{}, err
+		}
+		msg = p.NewPublicKey
+	case KindPKIRevoke:
+		p, err := r.PKIRevoke()
+		if err != nil {
+			return common.Hash{}, err
+		}
+		msg = "revoke" + p.Address
+	case KindTrustSubmit:
+		p, err := r.TrustSubmit()
+		if err != nil {
+			return common.Hash{}, err
+		}
+		value, err := strconv.ParseFloat(p.TrustValue, 64)
+		if err != nil {
+			return common.Hash{}, err
+		}
+		if msg, err = TrustMessage(p.AddressI, p.AddressJ, value, int64(r.Timestamp)); err != nil {
+			return common.Hash{}, err
+		}
+	default:
+		return common.Hash{}, fmt.Errorf("unknown record kind %v", r.Kind)
+	}
+	return crypto.Keccak256Hash([]byte(msg)), nil
+}
+
+// TrustMessage returns the message a trust submission is signed over. It
+// holds the value to six decimals, so values with more are refused rather
+// than stored with digits the signature does not cover.
+func TrustMessage(addressI, addressJ string, value float64, timestamp int64) (string, error) {
+	signed := strconv.FormatFloat(value, 'f', 6, 64)
+	if exact, _ := strconv.ParseFloat(signed, 64); exact != value {
+		return "", fmt.Errorf("trust value %v has more than six decimals", value)
+	}
+	return fmt.Sprintf("submit%s.%s.%s.%d", addressI, addressJ, signed, timestamp), nil
+}
+
+// Sign sets Signer and Signature using prv.
+func (r *Record) Sign(prv *ecdsa.PrivateKey) error {
+	hash, err := r.SigningHash()
+	if err != nil {
+		return err
+	}
+	sig, err := crypto.Sign(hash.Bytes(), prv)
+	if err != nil {
+		return err
+	}
+	r.Signer = crypto.FromECDSAPub(&prv.PublicKey)
+	r.Signature = sig
+	return nil
+}
+
+// Verify checks every signature carried by the record. It does not check
+// the record against any state.
+func (r *Record) Verify() error {
+	hash, err := r.SigningHash()
+	if err != nil {
+		return err
+	}
+	if err := verifySignature(hash, r.Signature, r.Signer); err != nil {
+		return err
+	}
+
+	switch r.Kind {
+	case KindPKIUpdate:
+		p, _ := r.PKIUpdate()
+		newPublicKey, err := hex.DecodeString(p.NewPublicKey)
+		if err != nil {
+			return errors.New("invalid new public key format")
+		}
+		registerHash := crypto.Keccak256Hash([]byte("register" + p.Address))
+		if err := verifySignature(registerHash, p.NewSignature, newPublicKey); err != nil {
+			return errors.New("wrong signature for new public key")
+		}
+	case KindTrustSubmit:
+		p, _ := r.TrustSubmit()
+		if strings.ToLower(SignerAddress(r.Signer)) != strings.ToLower(p.AddressI) {
+			return errors.New("wrong signature")
+		}
+	}
+	return nil
+}
+
+func verifySignature(hash common.Hash, signature, publicKey []byte) error {
+	recovered, err := crypto.SigToPub(hash.Bytes(), signature)
+	if err != nil {
+		return errors.New("unable to recover public key from signature")
+	}
+	if !bytes.Equal(crypto.FromECDSAPub(recovered), publicKey) {
+		return errors.New("signature does not match signer")
+	}
+	return nil
+}
+
+// SignerAddress returns the 0x-prefixed hex address of a public key.
+func SignerAddress(publicKey []byte) string {
+	if len(publicKey) == 0 {
+		return ""
+	}
+	return "0x" + hex.EncodeToString(crypto.Keccak256(publicKey[1:])[12:])
+}
+
+func mustEncode(val interface{}) []byte {
+	data, err := rlp.EncodeToBytes(val)
+	if err != nil {
+		log.Panic(err)
+	}
+	return data
+}
@@ -0,0 +1,54 @@
+package record
+
+import (
+	"github.com/ethereum/go-ethereum/crypto"
+	"testing"
+)
+
+func TestHashIgnoresUnsignedFields(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := SignerAddress(crypto.FromECDSAPub(&key.PublicKey))
+
+	register := NewPKIRegister(address, nil, nil, 1)
+	if err := register.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	restamped := *register
+	restamped.Nonce, restamped.Timestamp = 7, 2
+	if err := restamped.Verify(); err != nil {
+		t.Fatalf("restamped record no longer verifies: %v", err)
+	}
+	if restamped.Hash() != register.Hash() {
+		t.Error("restamping a PKI record changed its hash")
+	}
+
+	data := NewData([]byte("data"), 1, 1)
+	if err := data.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	next := NewData([]byte("data"), 2, 1)
+	if err := next.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	if next.Hash() == data.Hash() {
+		t.Error("data records with different nonces have the same hash")
+	}
+}
+
+func TestTrustValuePrecision(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := SignerAddress(crypto.FromECDSAPub(&key.PublicKey))
+
+	if err := NewTrustSubmit(address, "0x01", 0.123456, nil, nil, 1).Sign(key); err != nil {
+		t.Errorf("trust value with six decimals refused: %v", err)
+	}
+	if err := NewTrustSubmit(address, "0x01", 0.1234567, nil, nil, 1).Sign(key); err == nil {
+		t.Error("trust value with more decimals than signed accepted")
+	}
+}
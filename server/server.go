@@ -1,27 +1,92 @@
 package server
 
 import (
+	"crypto/tls"
 	"fmt"
+	"github.com/duanjr/trustchain/blockchain"
+	"github.com/duanjr/trustchain/consensus"
+	"github.com/duanjr/trustchain/mempool"
 	"github.com/duanjr/trustchain/node"
+	"github.com/duanjr/trustchain/p2p"
 	"github.com/gorilla/mux"
 	"log"
 	"net/http"
 )
 
-func RunServer() {
-	node := node.NewNode()
+// Config is what a node is started with.
+type Config struct {
+	DataDir string
+	// Genesis starts the chain, or is nil for the default genesis.
+	Genesis   *blockchain.Genesis
+	Consensus consensus.Config
+	Producer  blockchain.ProducerConfig
+	Trust     blockchain.TrustParams
+	Mempool   mempool.Config
+	Peers     p2p.Config
+	Listen    ListenConfig
+}
+
+func RunServer(cfg Config) {
+	engine, err := consensus.New(cfg.Consensus)
+	if err != nil {
+		log.Fatalf("Error creating consensus engine: %v", err)
+	}
+	node, err := node.NewNode(cfg.DataDir, engine, cfg.Genesis, cfg.Trust)
+	if err != nil {
+		log.Fatalf("Error opening blockchain: %v", err)
+	}
+	node.SetMempool(cfg.Mempool)
+	node.SetPeerConfig(cfg.Peers)
+	clientTLS, err := clientTLSConfig(cfg.Listen, node)
+	if err != nil {
+		log.Fatalf("Error configuring TLS: %v", err)
+	}
 
 	router := mux.NewRouter()
 	router.HandleFunc("/add-record", node.AddRecord).Methods("POST")
 	router.HandleFunc("/blocks", node.GetBlockchain).Methods("GET")
+	router.HandleFunc("/pending", node.GetPending).Methods("GET")
+	router.HandleFunc("/mempool", node.GetMempool).Methods("GET")
+	router.HandleFunc("/blocks/{hash}/records/{index}/proof", node.GetRecordProof).Methods("GET")
 	router.HandleFunc("/add-peer", node.AddPeerHandler).Methods("POST")
 	router.HandleFunc("/pki/register", node.AddPKIRecord).Methods("POST")
 	router.HandleFunc("/pki/update", node.UpdatePKIRecord).Methods("POST")
 	router.HandleFunc("/pki/query", node.QueryPKIRecord).Methods("POST")
+	router.HandleFunc("/pki/revoke", node.RevokePKIRecord).Methods("POST")
 	router.HandleFunc("/trust/submit", node.TrustSubmitRecord).Methods("POST")
 	router.HandleFunc("/trust/query-direct", node.DirectTrustQueryRecord).Methods("POST")
 	router.HandleFunc("/trust/query-comp", node.CompTrustQuery).Methods("POST")
 	router.HandleFunc("/trust/query-comp-calc", node.CalcCompTrustQuery).Methods("POST")
-	fmt.Println("Server listening on :8080...")
-	log.Fatal(http.ListenAndServe(":8080", router))
+
+	peerRouter := mux.NewRouter()
+	peerRouter.Use(node.SignResponses)
+	peerRouter.HandleFunc("/blocks/{hash}", node.Authenticated(node.GetBlock)).Methods("GET")
+	peerRouter.HandleFunc("/headers", node.Authenticated(node.GetHeaders)).Methods("GET")
+	peerRouter.HandleFunc("/status", node.Authenticated(node.GetStatus)).Methods("GET")
+	peerRouter.HandleFunc("/peers", node.Authenticated(node.GetPeers)).Methods("GET")
+	peerRouter.HandleFunc("/p2p/handshake", node.Authenticated(node.Handshake)).Methods("POST")
+	peerRouter.HandleFunc("/gossip/record", node.Authenticated(node.GossipRecord)).Methods("POST")
+	peerRouter.HandleFunc("/gossip/block", node.Authenticated(node.GossipBlock)).Methods("POST")
+	if bft, ok := engine.(*consensus.BFT); ok {
+		peerRouter.HandleFunc("/consensus/proposal", node.Authenticated(node.ConsensusProposal)).Methods("POST")
+		peerRouter.HandleFunc("/consensus/vote", node.Authenticated(node.ConsensusVote)).Methods("POST")
+		peerRouter.HandleFunc("/consensus/commit", node.Authenticated(node.ConsensusCommit)).Methods("POST")
+		go bft.Run(node)
+	} else {
+		go node.RunProducer(cfg.Producer)
+	}
+	go node.RunPeers()
+	go serve("Peer API", cfg.Listen.PeerAddress, peerRouter, node.PeerTLSConfig())
+	serve("Client API", cfg.Listen.ClientAddress, router, clientTLS)
+}
+
+// serve serves handler at address, over TLS if config is not nil.
+func serve(name, address string, handler http.Handler, config *tls.Config) {
+	server := &http.Server{Addr: address, Handler: handler, TLSConfig: config}
+	if config == nil {
+		fmt.Printf("%s listening on %s...\n", name, address)
+		log.Fatal(server.ListenAndServe())
+	}
+	fmt.Printf("%s listening on %s over TLS...\n", name, address)
+	log.Fatal(server.ListenAndServeTLS("", ""))
 }
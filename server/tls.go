@@ -0,0 +1,82 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/duanjr/trustchain/node"
+	"os"
+)
+
+// ListenConfig says where the client and peer APIs are served and how the
+// client API is secured. Whether the peer API uses TLS is part of the peer
+// configuration, since peers must agree on it.
+type ListenConfig struct {
+	ClientAddress string
+	PeerAddress   string
+	// TLS serves the client API over TLS, with the certificate in CertFile
+	// and KeyFile, or the identity certificate of the node key if they are
+	// empty.
+	TLS      bool
+	CertFile string
+	KeyFile  string
+	// ClientCAFile requires clients to present a certificate signed by one
+	// of the CAs in the file.
+	ClientCAFile string
+	// ClientPKI requires clients to present the identity certificate of a
+	// key the PKI trie holds.
+	ClientPKI bool
+}
+
+var DefaultListenConfig = ListenConfig{
+	ClientAddress: ":8080",
+	PeerAddress:   ":8081",
+}
+
+// clientTLSConfig returns the TLS configuration of the client API, or nil if
+// it is served without TLS.
+func clientTLSConfig(cfg ListenConfig, n *node.Node) (*tls.Config, error) {
+	if !cfg.TLS {
+		if cfg.ClientCAFile != "" || cfg.ClientPKI {
+			return nil, errors.New("client certificates require TLS")
+		}
+		return nil, nil
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	switch {
+	case cfg.CertFile != "" && cfg.KeyFile != "":
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	case cfg.CertFile == "" && cfg.KeyFile == "":
+		config.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return n.Certificate()
+		}
+	default:
+		return nil, errors.New("certificate and key files must be given together")
+	}
+
+	if cfg.ClientCAFile != "" {
+		data, err := os.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates in %s", cfg.ClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if cfg.ClientPKI {
+		if config.ClientAuth == tls.NoClientCert {
+			config.ClientAuth = tls.RequireAnyClientCert
+		}
+		config.VerifyPeerCertificate = n.VerifyClientCertificate
+	}
+	return config, nil
+}
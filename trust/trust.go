@@ -4,27 +4,27 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"errors"
-	"fmt"
+	"github.com/duanjr/trustchain/blockchain"
+	"github.com/duanjr/trustchain/record"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
-	"github.com/ethereum/go-ethereum/trie"
 	"math"
-	"strconv"
 	"strings"
 	"time"
 )
 
-var Trie *trie.Trie
-var PKITrie *trie.Trie
-var CompTrie *trie.Trie
-var id2DT map[string]map[string]float64
-var addressList *[]string
-
-func Initialize(t1 *trie.Trie, t2 *trie.Trie, t3 *trie.Trie, m map[string]map[string]float64, a *[]string) {
-	Trie = t1
-	PKITrie = t2
-	CompTrie = t3
-	id2DT = m
-	addressList = a
+// Engine verifies the signatures of trust submissions and answers trust
+// queries from a chain's state. Whether a submission fits the state, such as
+// whether its sender is registered, is checked when the node applies its
+// record.
+type Engine struct {
+	state func() *blockchain.State
+}
+
+// NewEngine returns an engine of the state state returns, which is asked for
+// on every request since the chain replaces it as blocks are added.
+func NewEngine(state func() *blockchain.State) *Engine {
+	return &Engine{state: state}
 }
 
 type SubmitRequest struct {
@@ -35,71 +35,72 @@ type SubmitRequest struct {
 	Signature  string  `json:"signature"`
 }
 
-func Submit(req SubmitRequest) error {
+// Submit verifies a trust submission and returns the record to be included
+// in the next block. The record changes the trust state once the node
+// applies it.
+func (e *Engine) Submit(req SubmitRequest) (*record.Record, error) {
 	if req.TrustValue > 1 || req.TrustValue < -1 {
-		return errors.New("expected trustValue between 1 and -1")
+		return nil, errors.New("expected trustValue between 1 and -1")
 	}
 
 	currentTime := time.Now().Unix()
 	if math.Abs(float64(req.Timestamp-currentTime)) > 40 {
-		return errors.New("invalid timestamp")
+		return nil, errors.New("invalid timestamp")
 	}
 
-	msg := fmt.Sprintf("submit%s.%s.%f.%d", req.AddressI, req.AddressJ, req.TrustValue, req.Timestamp)
+	msg, err := record.TrustMessage(req.AddressI, req.AddressJ, req.TrustValue, req.Timestamp)
+	if err != nil {
+		return nil, err
+	}
 	hashedMessage := crypto.Keccak256Hash([]byte(msg))
 	signature, err := base64.StdEncoding.DecodeString(req.Signature)
 	if err != nil {
-		return errors.New("invalid signature")
+		return nil, errors.New("invalid signature")
 	}
 
 	addressRecover, err := crypto.Ecrecover(hashedMessage.Bytes(), signature)
 	if err != nil {
-		return errors.New("unable to recover address")
+		return nil, errors.New("unable to recover address")
 	}
 
 	addressBytes := crypto.Keccak256(addressRecover[1:])[12:]
 	address := hex.EncodeToString(addressBytes)
 	if strings.ToLower("0x"+address) != strings.ToLower(req.AddressI) {
-		return errors.New("wrong signature")
+		return nil, errors.New("wrong signature")
 	}
 
-	if _, err := PKITrie.TryGet([]byte(req.AddressI)); err != nil {
-		return errors.New("Address " + req.AddressI + " is not registered")
-	}
-
-	id2DT[req.AddressI][req.AddressJ] = req.TrustValue
-	Trie.Update([]byte(req.AddressI+req.AddressJ), []byte(strconv.FormatFloat(req.TrustValue, 'f', -1, 64)))
-
-	if !contains(*addressList, req.AddressI) {
-		*addressList = append(*addressList, req.AddressI)
-	}
-	if !contains(*addressList, req.AddressJ) {
-		*addressList = append(*addressList, req.AddressJ)
-	}
-
-	return nil
-}
-
-func contains(slice []string, value string) bool {
-	for _, item := range slice {
-		if item == value {
-			return true
-		}
-	}
-	return false
+	return record.NewTrustSubmit(req.AddressI, req.AddressJ, req.TrustValue, addressRecover, signature, uint64(req.Timestamp)), nil
 }
 
 type QueryRequest struct {
 	AddressI string `json:"addressI"`
 	AddressJ string `json:"addressJ"`
+	Proof    bool   `json:"proof"`
+	Block    string `json:"block"`
+}
+
+const (
+	KindDirect = "direct"
+	KindComp   = "comp"
+)
+
+type QueryProofResponse struct {
+	Kind       string                 `json:"kind"`
+	AddressI   string                 `json:"addressI"`
+	AddressJ   string                 `json:"addressJ"`
+	TrustValue string                 `json:"trustValue"`
+	Proof      *blockchain.StateProof `json:"proof"`
 }
 
-func QueryDirect(req QueryRequest) (string, error) {
+// QueryDirect looks a pair up in a copy of the direct trust trie, so it may
+// run concurrently with other readers.
+func (e *Engine) QueryDirect(req QueryRequest) (string, error) {
 	if req.AddressI == "" || req.AddressJ == "" {
 		return "", errors.New("missing address")
 	}
 
-	pubkeyBytes, err := Trie.TryGet([]byte(req.AddressI + req.AddressJ))
+	_, directTrustTrie, _ := e.state().ReadTries()
+	pubkeyBytes, err := directTrustTrie.TryGet(blockchain.DirectTrustKey(req.AddressI, req.AddressJ))
 	if err != nil {
 		return "", errors.New("no such trust pair")
 	}
@@ -107,15 +108,51 @@ func QueryDirect(req QueryRequest) (string, error) {
 	return hex.EncodeToString(pubkeyBytes), nil
 }
 
-func QueryComp(req QueryRequest) (string, error) {
+// QueryComp looks a pair up in a copy of the composite trust trie.
+func (e *Engine) QueryComp(req QueryRequest) (string, error) {
 	if req.AddressI == "" || req.AddressJ == "" {
 		return "", errors.New("missing address")
 	}
 
-	pubkeyBytes, err := CompTrie.TryGet([]byte(req.AddressI + req.AddressJ))
+	_, _, compTrustTrie := e.state().ReadTries()
+	pubkeyBytes, err := compTrustTrie.TryGet(blockchain.CompTrustKey(req.AddressI, req.AddressJ))
 	if err != nil {
 		return "", errors.New("no such trust pair")
 	}
 
 	return hex.EncodeToString(pubkeyBytes), nil
 }
+
+// Calculate computes the composite trust of a pair from the current direct
+// trust values rather than the last committed ones.
+func (e *Engine) Calculate(req QueryRequest) float64 {
+	return e.state().CompTrust(req.AddressI, req.AddressJ)
+}
+
+// VerifyTrustProof checks a proof-carrying trust answer without access to
+// the node's state. root must be the DirectTrustRootHash or CompTrustRootHash,
+// matching resp.Kind, of a block the caller trusts.
+func VerifyTrustProof(resp *QueryProofResponse, root common.Hash) error {
+	if resp.Proof == nil || resp.Proof.Root != root {
+		return errors.New("proof is not anchored to the expected root")
+	}
+
+	var key []byte
+	switch resp.Kind {
+	case KindDirect:
+		key = blockchain.DirectTrustKey(resp.AddressI, resp.AddressJ)
+	case KindComp:
+		key = blockchain.CompTrustKey(resp.AddressI, resp.AddressJ)
+	default:
+		return errors.New("unknown trust kind " + resp.Kind)
+	}
+
+	value, err := blockchain.VerifyStateProof(key, resp.Proof)
+	if err != nil {
+		return err
+	}
+	if string(value) != resp.TrustValue {
+		return errors.New("trust value does not match proof")
+	}
+	return nil
+}